@@ -0,0 +1,327 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/mattn/go-sqlite3"
+)
+
+// handleAdminRestore restores the database from the replica while the
+// application is running.
+//
+// The replica is restored to a temporary file which is then copied into the
+// live database using SQLite's online backup API. Because the copy goes
+// through a regular connection, the new pages are written to the WAL and
+// replicated by Litestream like any other write. Application writes are
+// blocked while the copy is in progress.
+//
+// An optional "timestamp" query parameter restores to a point-in-time. Once
+// the restore begins, progress is streamed as server-sent events ending with
+// either a "done" or an "error" event.
+func (s *Server) handleAdminRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opt := litestream.NewRestoreOptions()
+	if v := r.URL.Query().Get("timestamp"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			Error(w, r, fmt.Errorf("invalid timestamp: %w", err), http.StatusBadRequest)
+			return
+		}
+		opt.Timestamp = t.UTC()
+	}
+
+	// Restore into a temporary directory on the same volume as the database.
+	dir, err := os.MkdirTemp(filepath.Dir(s.LSDB.Path()), ".restore-")
+	if err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	opt.OutputPath = filepath.Join(dir, "db")
+
+	replica := s.LSDB.Replica(s.Config.RestoreFrom)
+	if opt.Generation, _, err = replica.CalcRestoreTarget(r.Context(), opt); err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	} else if opt.Generation == "" {
+		Error(w, r, litestream.ErrNoGeneration, http.StatusNotFound)
+		return
+	}
+
+	// Track progress by parsing the restore log output.
+	progress, err := NewRestoreProgress(r.Context(), replica, opt, os.Stderr)
+	if err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	opt.Logger = log.New(progress, "", log.LstdFlags|log.Lmicroseconds)
+
+	// Stream progress events to the client from here on. A client disconnect
+	// cancels the request context which cancels the restore.
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	event := func(name, format string, args ...interface{}) {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, fmt.Sprintf(format, args...))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	log.Printf("live restore started: generation=%s", opt.Generation)
+	event("start", "generation=%s index=[%08x,%08x]", opt.Generation, progress.MinIndex, progress.MaxIndex)
+
+	// Restore in the background and report progress periodically.
+	ch := make(chan error, 1)
+	go func() { ch <- replica.Restore(r.Context(), opt) }()
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+LOOP:
+	for {
+		select {
+		case <-ticker.C:
+			index, fraction := progress.Status()
+			event("progress", "index=%08x percent=%.1f", index, fraction*100)
+		case err = <-ch:
+			break LOOP
+		}
+	}
+	if err != nil {
+		log.Printf("live restore failed: %s", err)
+		adminAuditFailed(r, err)
+		event("error", "%s", err)
+		return
+	}
+
+	// Block application writes while copying into the live database. Reads
+	// are answered per -read-during-restore until the copy is replicated.
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.SetRestoring(true)
+	defer s.SetRestoring(false)
+
+	// The restore starts a new generation which must not trip the guard.
+	s.GenerationGuard.Suspend()
+	defer func() {
+		pos, _ := s.LSDB.Pos()
+		s.GenerationGuard.Resume(pos.Generation)
+	}()
+
+	startTime := time.Now()
+	if err := backup(s.LSDB.Path(), opt.OutputPath); err != nil {
+		log.Printf("live restore failed: cannot apply restore: %s", err)
+		adminAuditFailed(r, err)
+		event("error", "cannot apply restore: %s", err)
+		return
+	}
+
+	// Discard journaled visits, which the restore may have rolled back, and
+	// number new visits after the restored rows.
+	if s.Journal != nil {
+		if err := s.Journal.Reset(r.Context(), s.DB); err != nil {
+			log.Printf("live restore failed: cannot reset journal: %s", err)
+			adminAuditFailed(r, err)
+			event("error", "cannot reset journal: %s", err)
+			return
+		}
+	}
+
+	// Replicate the new contents right away.
+	if err := s.LSDB.Sync(r.Context()); err != nil {
+		log.Printf("live restore failed: %s", err)
+		adminAuditFailed(r, err)
+		event("error", "%s", err)
+		return
+	}
+	log.Printf("live restore complete: generation=%s elapsed=%s", opt.Generation, time.Since(startTime))
+
+	// Reload the cached count so reads do not serve the old contents.
+	if s.CountCache != nil {
+		if err := s.CountCache.Load(r.Context()); err != nil {
+			log.Printf("cannot reload cached count after live restore: %s", err)
+		}
+	}
+
+	// Move queries onto fresh connections once requests using the old ones
+	// have finished. Writes are held until the handler returns.
+	go s.resetConns(ConnResetTimeout)
+
+	event("done", "restored generation %s", opt.Generation)
+}
+
+// ConnResetTimeout is the maximum time resetConns waits for in-use
+// connections to be returned.
+const ConnResetTimeout = 30 * time.Second
+
+// defaultMaxIdleConns is database/sql's default number of idle connections.
+const defaultMaxIdleConns = 2
+
+// resetConns replaces the pooled connections to the database. The database
+// file is never replaced, but connections keep state such as the page cache
+// & prepared statements across a live restore. Idle connections are closed
+// right away and connections in use are closed as they are returned, for up
+// to timeout, so the pool is refilled with new connections.
+func (s *Server) resetConns(timeout time.Duration) {
+	dbs := []*sql.DB{s.DB}
+	if s.ReadDB != nil {
+		dbs = append(dbs, s.ReadDB)
+	}
+
+	// No connection is returned to the pool while idle connections are off.
+	for _, db := range dbs {
+		db.SetMaxIdleConns(0)
+	}
+	defer func() {
+		for _, db := range dbs {
+			db.SetMaxIdleConns(defaultMaxIdleConns)
+		}
+	}()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.Now().Add(timeout)
+	for {
+		inUse := 0
+		for _, db := range dbs {
+			inUse += db.Stats().InUse
+		}
+		if inUse == 0 {
+			log.Printf("database connections reset")
+			return
+		} else if time.Now().After(deadline) {
+			log.Printf("database connections still in use after %s, %d will be reused", timeout, inUse)
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// handleAdminMaintenance reports the maintenance mode on GET and changes it on
+// POST. The "enabled" query parameter sets the mode explicitly, otherwise a
+// POST toggles it.
+func (s *Server) handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled := !s.Maintenance()
+		if v := r.URL.Query().Get("enabled"); v != "" {
+			var err error
+			if enabled, err = strconv.ParseBool(v); err != nil {
+				Error(w, r, fmt.Errorf("invalid enabled value: %w", err), http.StatusBadRequest)
+				return
+			}
+		}
+		s.SetMaintenance(enabled)
+		log.Printf("maintenance mode set: enabled=%t", enabled)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Reflect the current mode since it may have changed in this request.
+	if s.Maintenance() {
+		w.Header().Set("X-Maintenance", "true")
+	} else {
+		w.Header().Del("X-Maintenance")
+	}
+	Text(w, "maintenance=%t\n", s.Maintenance())
+}
+
+// handleAdminDownload streams a consistent copy of the database as a file
+// download. The copy is made with SQLite's online backup API into a temporary
+// file first. It reads the database within a single read transaction so, in
+// WAL mode, writers are not blocked while it runs.
+func (s *Server) handleAdminDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Copy into a temporary directory on the same volume as the database.
+	dir, err := os.MkdirTemp(filepath.Dir(s.LSDB.Path()), ".download-")
+	if err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	startTime := time.Now()
+	path := filepath.Join(dir, "db")
+	if err := backup(path, s.LSDB.Path()); err != nil {
+		Error(w, r, fmt.Errorf("cannot copy database: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("database download: size=%d copy=%s", fi.Size(), time.Since(startTime))
+
+	// ServeContent sets the Content-Length & handles HEAD and range requests.
+	name := fmt.Sprintf("%s-%s.db", strings.TrimSuffix(filepath.Base(s.LSDB.Path()), filepath.Ext(s.LSDB.Path())), startTime.UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, startTime, f)
+}
+
+// backup copies the database at src into the database at dst using the SQLite
+// online backup API. All pages are copied in a single step so the write lock
+// on dst is held for the entire copy. Other connections writing to dst, such
+// as Litestream's checkpoints, wait on the busy timeout until it completes.
+func backup(dst, src string) error {
+	var d sqlite3.SQLiteDriver
+
+	dstConn, err := d.Open(dst + "?_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	srcConn, err := d.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	b, err := dstConn.(*sqlite3.SQLiteConn).Backup("main", srcConn.(*sqlite3.SQLiteConn), "main")
+	if err != nil {
+		return err
+	}
+
+	if done, err := b.Step(-1); err != nil {
+		b.Finish()
+		return err
+	} else if !done {
+		b.Finish()
+		return fmt.Errorf("backup did not complete")
+	}
+	return b.Finish()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Ensure queries keep working while a live restore is copied into the
+// database and the connection pools are reset, and that every pooled
+// connection sees the restored contents afterwards.
+func TestServer_resetConns(t *testing.T) {
+	dir := t.TempDir()
+	path, restoredPath := filepath.Join(dir, "db"), filepath.Join(dir, "restored")
+	createTestPageViews(t, restoredPath, 50)
+	createTestPageViews(t, path, 3)
+
+	db, err := sql.Open("sqlite3", path+"?_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	readDB, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_query_only=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readDB.Close()
+	s := &Server{DB: db, ReadDB: readDB}
+
+	// Query both pools continuously until the restore has been applied and
+	// the reset has started.
+	var wg sync.WaitGroup
+	var queryN, restoredN int64
+	done := make(chan struct{})
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		pool := db
+		if i%2 == 1 {
+			pool = readDB
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				var n int
+				if err := pool.QueryRow(`SELECT COUNT(1) FROM page_views;`).Scan(&n); err != nil {
+					errs <- err
+					return
+				} else if n != 3 && n != 50 {
+					errs <- fmt.Errorf("unexpected count: %d", n)
+					return
+				} else if n == 50 {
+					atomic.AddInt64(&restoredN, 1)
+				}
+				atomic.AddInt64(&queryN, 1)
+			}
+		}()
+	}
+
+	// Let every query connection settle into the pools first.
+	time.Sleep(100 * time.Millisecond)
+	if err := backup(path, restoredPath); err != nil {
+		t.Fatal(err)
+	}
+
+	resetDone := make(chan struct{})
+	go func() { defer close(resetDone); s.resetConns(5 * time.Second) }()
+	time.Sleep(200 * time.Millisecond)
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("query failed during live restore: %s", err)
+	}
+	if atomic.LoadInt64(&restoredN) == 0 {
+		t.Fatalf("no query saw the restored data out of %d", atomic.LoadInt64(&queryN))
+	}
+
+	select {
+	case <-resetDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for connection reset")
+	}
+
+	for _, pool := range []*sql.DB{db, readDB} {
+		if stats := pool.Stats(); stats.MaxIdleClosed == 0 {
+			t.Fatal("expected pooled connections to be closed by the reset")
+		}
+
+		// Hold more connections than may be idle at once so a fresh pool
+		// is checked, then return them all.
+		conns := make([]*sql.Conn, defaultMaxIdleConns+1)
+		for i := range conns {
+			if conns[i], err = pool.Conn(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			var n int
+			if err := conns[i].QueryRowContext(context.Background(), `SELECT COUNT(1) FROM page_views;`).Scan(&n); err != nil {
+				t.Fatal(err)
+			} else if n != 50 {
+				t.Fatalf("connection %d: count=%d, want restored count 50", i, n)
+			}
+		}
+		for _, conn := range conns {
+			if err := conn.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Idle connections are kept again once the reset is over.
+		if idle := pool.Stats().Idle; idle != defaultMaxIdleConns {
+			t.Fatalf("idle=%d, want %d", idle, defaultMaxIdleConns)
+		}
+	}
+}
+
+// createTestPageViews creates a WAL mode database at path holding n page views.
+func createTestPageViews(t *testing.T, path string, n int) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`PRAGMA journal_mode = wal;`); err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Exec(`CREATE TABLE page_views (id INTEGER PRIMARY KEY, timestamp TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := db.Exec(`INSERT INTO page_views (timestamp) VALUES (?);`, formatTime(time.Now(), false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AdminAuditEntry records a single request to an admin endpoint.
+type AdminAuditEntry struct {
+	Time      time.Time         `json:"time"`
+	RequestID string            `json:"requestId"`
+	SourceIP  string            `json:"sourceIp"`
+	Principal string            `json:"principal"`
+	Action    string            `json:"action"`
+	Method    string            `json:"method"`
+	Params    map[string]string `json:"params,omitempty"`
+	Status    int               `json:"status"`
+	Outcome   string            `json:"outcome"` // success, failure or denied
+	Error     string            `json:"error,omitempty"`
+	ElapsedMS int64             `json:"elapsedMs"`
+}
+
+// AdminAuditLog writes admin audit entries as JSON lines to a file. A nil
+// log writes them to the application log instead.
+type AdminAuditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenAdminAuditLog opens the audit log at path for appending. The file is
+// only readable by the owner as entries include query parameters.
+func OpenAdminAuditLog(path string) (*AdminAuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AdminAuditLog{f: f}, nil
+}
+
+// Close closes the underlying file.
+func (l *AdminAuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// Write records e. Failures to write are logged but do not fail the request
+// since the action has already been performed.
+func (l *AdminAuditLog) Write(e AdminAuditEntry) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("cannot encode admin audit entry: %s", err)
+		return
+	}
+
+	if l == nil {
+		log.Printf("admin audit: %s", buf)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(buf, '\n')); err != nil {
+		log.Printf("cannot write admin audit entry: %s", err)
+	}
+}
+
+// adminAuditContextKey is the context key of the entry for a request.
+type adminAuditContextKey struct{}
+
+// adminAuditFailed marks the action of r as failed with err. Handlers call it
+// for failures that happen after the response status has been sent, such as
+// a live restore which streams its progress.
+func adminAuditFailed(r *http.Request, err error) {
+	if e, ok := r.Context().Value(adminAuditContextKey{}).(*AdminAuditEntry); ok {
+		e.Error = err.Error()
+	}
+}
+
+// auditAdmin wraps h so that every request to it, including ones which fail
+// authentication, is written to the admin audit log once it completes. The
+// request ID is taken from the X-Request-Id header, if set, and is returned
+// in the response either way.
+func (s *Server) auditAdmin(action string, h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := &AdminAuditEntry{
+			Time:      time.Now().UTC(),
+			RequestID: requestID(r),
+			SourceIP:  sourceIP(r),
+			Principal: s.AdminAuth.Principal(r),
+			Action:    action,
+			Method:    r.Method,
+		}
+		if q := r.URL.Query(); len(q) > 0 {
+			e.Params = make(map[string]string, len(q))
+			for k := range q {
+				e.Params[k] = q.Get(k)
+			}
+		}
+		w.Header().Set("X-Request-Id", e.RequestID)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), adminAuditContextKey{}, e)))
+
+		e.Status = rec.status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		switch {
+		case e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden:
+			e.Outcome = "denied"
+		case e.Status >= 400 || e.Error != "":
+			e.Outcome = "failure"
+		default:
+			e.Outcome = "success"
+		}
+		e.ElapsedMS = time.Since(e.Time).Milliseconds()
+		s.AdminAuditLog.Write(*e)
+	}
+}
+
+// Principal returns the identity authenticated by r, or the identity it
+// claimed if authentication failed. Tokens are shared so are not identified.
+func (a *AdminAuth) Principal(r *http.Request) string {
+	if a == nil {
+		return "anonymous"
+	}
+	switch a.Mode {
+	case AdminAuthToken:
+		return "token"
+	case AdminAuthBasic:
+		if username, _, ok := r.BasicAuth(); ok {
+			return username
+		}
+	case AdminAuthClientCert:
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			return r.TLS.PeerCertificates[0].Subject.String()
+		}
+	}
+	return "anonymous"
+}
+
+// maxRequestIDLen is the longest client supplied request ID that is used.
+const maxRequestIDLen = 128
+
+// requestID returns the X-Request-Id header of r or a new random ID.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= maxRequestIDLen {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// sourceIP returns the IP address of the client connection. Forwarding
+// headers are ignored as they can be set by the client.
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder captures the status code written by a handler. Flushes
+// are passed through so streaming responses still work.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Admin authentication modes.
+const (
+	AdminAuthNone       = "none"
+	AdminAuthToken      = "token"
+	AdminAuthBasic      = "basic"
+	AdminAuthClientCert = "mtls"
+)
+
+// AdminAuth authenticates requests to the admin & metrics endpoints.
+type AdminAuth struct {
+	Mode string
+
+	// Bearer token for the "token" mode.
+	Token string
+
+	// Credentials for the "basic" mode.
+	Username string
+	Password string
+}
+
+// NewAdminAuth returns the admin authentication described by config. Secrets
+// are read from files so they do not appear in the process arguments.
+func NewAdminAuth(config Config) (*AdminAuth, error) {
+	a := &AdminAuth{Mode: config.AdminAuth}
+
+	switch config.AdminAuth {
+	case AdminAuthNone:
+	case AdminAuthToken:
+		buf, err := readSecretFile(config.AdminTokenFile, "-admin-token-file")
+		if err != nil {
+			return nil, err
+		}
+		a.Token = buf
+
+	case AdminAuthBasic:
+		buf, err := readSecretFile(config.AdminBasicAuthFile, "-admin-basic-auth-file")
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.SplitN(buf, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("-admin-basic-auth-file must contain USERNAME:PASSWORD")
+		}
+		a.Username, a.Password = parts[0], parts[1]
+
+	case AdminAuthClientCert:
+		if config.TLSCert == "" {
+			return nil, errors.New("-admin-auth mtls requires -tls-cert")
+		} else if config.AdminClientCA == "" {
+			return nil, errors.New("-admin-auth mtls requires -admin-client-ca")
+		}
+
+	default:
+		return nil, fmt.Errorf("invalid -admin-auth: %q", config.AdminAuth)
+	}
+	return a, nil
+}
+
+// readSecretFile returns the trimmed contents of the file at path.
+func readSecretFile(path, flagName string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("required: %s PATH", flagName)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read %s: %w", flagName, err)
+	}
+	s := strings.TrimSpace(string(buf))
+	if s == "" {
+		return "", fmt.Errorf("%s is empty", flagName)
+	}
+	return s, nil
+}
+
+// ConfigureTLS requests client certificates signed by the CA in caPath for
+// the "mtls" mode. Certificates are optional at the TLS layer so that public
+// endpoints remain accessible; admin requests without one are rejected.
+func (a *AdminAuth) ConfigureTLS(config *tls.Config, caPath string) error {
+	if a.Mode != AdminAuthClientCert {
+		return nil
+	}
+
+	buf, err := os.ReadFile(caPath)
+	if err != nil {
+		return fmt.Errorf("cannot read -admin-client-ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return fmt.Errorf("no certificates found in -admin-client-ca: %s", caPath)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// Authenticate returns zero if r is authorized. Otherwise it returns 401 if
+// credentials are missing or 403 if they are invalid.
+func (a *AdminAuth) Authenticate(r *http.Request) int {
+	switch a.Mode {
+	case AdminAuthToken:
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return http.StatusUnauthorized
+		} else if !secureEqual(strings.TrimPrefix(auth, "Bearer "), a.Token) {
+			return http.StatusForbidden
+		}
+
+	case AdminAuthBasic:
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return http.StatusUnauthorized
+		} else if !secureEqual(username, a.Username) || !secureEqual(password, a.Password) {
+			return http.StatusForbidden
+		}
+
+	case AdminAuthClientCert:
+		// Verified chains are only set for certificates signed by the CA.
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return http.StatusUnauthorized
+		} else if len(r.TLS.VerifiedChains) == 0 {
+			return http.StatusForbidden
+		}
+	}
+	return 0
+}
+
+// secureEqual compares a & b in constant time.
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// requireAdmin wraps h so that it is only served to authenticated requests.
+func (s *Server) requireAdmin(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminAuth != nil {
+			if code := s.AdminAuth.Authenticate(r); code == http.StatusUnauthorized {
+				if s.AdminAuth.Mode == AdminAuthBasic {
+					w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+				} else if s.AdminAuth.Mode == AdminAuthToken {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+				}
+				Error(w, r, errors.New("authentication required"), code)
+				return
+			} else if code != 0 {
+				Error(w, r, errors.New("forbidden"), code)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// Replication audit methods.
+const (
+	// Compare the number of page views. Cheap but misses changed rows.
+	AuditMethodCount = "count"
+
+	// Compare a SHA-256 checksum of every page view. Reads every row.
+	AuditMethodChecksum = "checksum"
+)
+
+// auditSummary describes the page views up to and including a row id.
+type auditSummary struct {
+	rows     int64
+	checksum []byte // nil for the count method
+}
+
+// monitorAudit audits the replica on every interval until ctx is done.
+func (s *Server) monitorAudit(ctx context.Context, interval time.Duration, method string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.audit(ctx, method); err != nil && ctx.Err() == nil {
+			log.Printf("cannot audit replica: %s", err)
+		}
+	}
+}
+
+// audit restores the latest replicated state of the -restore-from replica to
+// a temporary file and compares its page views with the local database.
+//
+// The replica usually lags behind the local database so only page views up
+// to the highest id in the restored copy are compared. Page views are only
+// ever appended so those rows must match exactly.
+func (s *Server) audit(ctx context.Context, method string) error {
+	replica := s.LSDB.Replica(s.Config.RestoreFrom)
+	startTime := time.Now()
+
+	// The replica may still be catching up after a generation change.
+	generation, err := s.LSDB.CurrentGeneration()
+	if err != nil {
+		return err
+	}
+	opt := litestream.NewRestoreOptions()
+	opt.Generation = generation
+	if opt.Generation, _, err = replica.CalcRestoreTarget(ctx, opt); err != nil {
+		return err
+	} else if opt.Generation == "" {
+		log.Printf("replica audit skipped, generation not replicated yet: replica=%s generation=%s", replica.Name(), generation)
+		return nil
+	}
+
+	// Restore into a temporary directory on the same volume as the database.
+	dir, err := os.MkdirTemp(filepath.Dir(s.LSDB.Path()), ".audit-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	opt.OutputPath = filepath.Join(dir, "db")
+	if err := replica.Restore(ctx, opt); err != nil {
+		return fmt.Errorf("cannot restore replica: %w", err)
+	}
+
+	restored, err := sql.Open("sqlite3", opt.OutputPath)
+	if err != nil {
+		return err
+	}
+	defer restored.Close()
+
+	var maxID int64
+	if err := restored.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM page_views;`).Scan(&maxID); err != nil {
+		return fmt.Errorf("cannot read restored database: %w", err)
+	}
+
+	remote, err := summarizePageViews(ctx, restored, maxID, method)
+	if err != nil {
+		return fmt.Errorf("cannot read restored database: %w", err)
+	}
+	local, err := summarizePageViews(ctx, s.DB, maxID, method)
+	if err != nil {
+		return fmt.Errorf("cannot read local database: %w", err)
+	}
+
+	if local.rows != remote.rows || string(local.checksum) != string(remote.checksum) {
+		replicaDivergenceGauge.Set(1)
+		log.Printf("replica divergence detected: replica=%s generation=%s method=%s max_id=%d local_rows=%d replica_rows=%d local_checksum=%x replica_checksum=%x",
+			replica.Name(), opt.Generation, method, maxID, local.rows, remote.rows, local.checksum, remote.checksum)
+		return nil
+	}
+
+	replicaDivergenceGauge.Set(0)
+	log.Printf("replica audit passed: replica=%s generation=%s method=%s max_id=%d rows=%d elapsed=%s",
+		replica.Name(), opt.Generation, method, maxID, local.rows, time.Since(startTime).Round(time.Millisecond))
+	return nil
+}
+
+// summarizePageViews returns the number of page views in db with an id up to
+// maxID and, for the checksum method, a checksum of their contents.
+func summarizePageViews(ctx context.Context, db *sql.DB, maxID int64, method string) (auditSummary, error) {
+	var summary auditSummary
+	if method == AuditMethodCount {
+		err := db.QueryRowContext(ctx, `SELECT COUNT(1) FROM page_views WHERE id <= ?;`, maxID).Scan(&summary.rows)
+		return summary, err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT id, COALESCE(timestamp, '') FROM page_views WHERE id <= ? ORDER BY id;`, maxID)
+	if err != nil {
+		return summary, err
+	}
+	defer rows.Close()
+
+	h := sha256.New()
+	for rows.Next() {
+		var id int64
+		var timestamp string
+		if err := rows.Scan(&id, &timestamp); err != nil {
+			return summary, err
+		}
+		fmt.Fprintf(h, "%d|%s\n", id, timestamp)
+		summary.rows++
+	}
+	if err := rows.Err(); err != nil {
+		return summary, err
+	}
+	summary.checksum = h.Sum(nil)
+	return summary, nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/benbjohnson/litestream"
+	lss3 "github.com/benbjohnson/litestream/s3"
+)
+
+// Replica authentication failure policies.
+const (
+	// Rebuild the client so credentials are re-read from the provider chain
+	// and retry the request.
+	ReplicaAuthPolicyRefresh = "refresh"
+
+	// Only count failures. The server reports unhealthy at the threshold.
+	ReplicaAuthPolicyUnhealthy = "unhealthy"
+)
+
+// DefaultReplicaAuthFailureThreshold is the default number of consecutive
+// authentication failures before a replica is reported unhealthy.
+const DefaultReplicaAuthFailureThreshold = 3
+
+// isAuthError returns true if err is an authentication or authorization
+// failure from S3, such as expired or rotated credentials. Network errors &
+// throttling are not considered auth errors.
+func isAuthError(err error) bool {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && (reqErr.StatusCode() == http.StatusUnauthorized || reqErr.StatusCode() == http.StatusForbidden) {
+		return true
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case "ExpiredToken", "ExpiredTokenException", "InvalidAccessKeyId", "InvalidToken",
+			"SignatureDoesNotMatch", "AccessDenied", "RequestExpired", "TokenRefreshRequired":
+			return true
+		}
+	}
+	return false
+}
+
+var _ litestream.ReplicaClient = (*AuthClient)(nil)
+
+// AuthClient wraps an S3 replica client to detect authentication failures
+// in both the request path & Litestream's background sync. Depending on the
+// policy, the underlying client is rebuilt on failure so that rotated
+// credentials, such as STS tokens, are picked up. Errors returned lazily by
+// iterators are not observed.
+type AuthClient struct {
+	mu          sync.RWMutex
+	client      *lss3.ReplicaClient
+	creds       *credentials.Credentials // nil if using the default chain
+	version     uint64                   // credentialsVersion used by client
+	failures    int                      // consecutive auth failures
+	lastWriteAt time.Time                // time of last successful WAL segment write
+	name        string
+	policy      string
+	threshold   int
+}
+
+// NewAuthClient returns a new AuthClient wrapping client for the named replica.
+// If creds is not nil then they are renewed from their provider as they
+// expire & on refresh, and client is replaced each time they are exported.
+func NewAuthClient(client *lss3.ReplicaClient, creds *credentials.Credentials, name, policy string, threshold int) *AuthClient {
+	return &AuthClient{
+		client:    client,
+		creds:     creds,
+		version:   atomic.LoadUint64(&credentialsVersion),
+		name:      name,
+		policy:    policy,
+		threshold: threshold,
+	}
+}
+
+// current returns the underlying client to use for a request. Provider
+// credentials are renewed first if they are about to expire, and the client
+// is replaced if they were exported since it was created.
+func (c *AuthClient) current() (*lss3.ReplicaClient, error) {
+	if c.creds == nil {
+		return c.Unwrap(), nil
+	} else if _, err := c.creds.Get(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v := atomic.LoadUint64(&credentialsVersion); v != c.version {
+		c.client, c.version = cloneClient(c.client), v
+	}
+	return c.client, nil
+}
+
+// Unwrap returns the current underlying S3 client.
+func (c *AuthClient) Unwrap() *lss3.ReplicaClient {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.client
+}
+
+// LastWriteAt returns the time WAL data was last written to the replica.
+func (c *AuthClient) LastWriteAt() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastWriteAt
+}
+
+// Healthy returns false once consecutive auth failures reach the threshold.
+func (c *AuthClient) Healthy() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.threshold <= 0 || c.failures < c.threshold
+}
+
+// do executes fn against the underlying client and applies the auth failure
+// policy to the result. If retry is true, the client was refreshed and the
+// retry budget allows it then fn is executed once more. Operations which
+// consume a reader must not retry.
+func (c *AuthClient) do(retry bool, fn func(client *lss3.ReplicaClient) error) error {
+	client, err := c.current()
+	if err != nil {
+		return err
+	}
+	err = fn(client)
+	if !isAuthError(err) {
+		if err == nil {
+			c.succeeded()
+		}
+		return err
+	}
+
+	if c.failed(err) && retry && retryBudget.Allow() {
+		if client, err = c.current(); err != nil {
+			return err
+		} else if err = fn(client); !isAuthError(err) {
+			if err == nil {
+				c.succeeded()
+			}
+			return err
+		}
+		c.failed(err)
+	}
+	return err
+}
+
+// failed records an auth failure. Returns true if the client was refreshed.
+func (c *AuthClient) failed(err error) bool {
+	replicaAuthFailureCounter.Inc()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failures++
+	log.Printf("replica authentication failed: replica=%s failures=%d policy=%s err=%s", c.name, c.failures, c.policy, err)
+	if c.failures == c.threshold {
+		log.Printf("replica unhealthy after repeated authentication failures: replica=%s", c.name)
+	}
+
+	if c.policy != ReplicaAuthPolicyRefresh {
+		return false
+	}
+
+	// Credentials from a provider are fetched again on the next request,
+	// which also replaces the client.
+	if c.creds != nil {
+		c.creds.Expire()
+		return true
+	}
+	c.client = cloneClient(c.client)
+	return true
+}
+
+// cloneClient returns a new client with the configuration of client. The new
+// client creates a new AWS session on first use which re-reads credentials
+// from the environment, files & provider chain.
+func cloneClient(client *lss3.ReplicaClient) *lss3.ReplicaClient {
+	other := lss3.NewReplicaClient()
+	other.AccessKeyID = client.AccessKeyID
+	other.SecretAccessKey = client.SecretAccessKey
+	other.Region = client.Region
+	other.Bucket = client.Bucket
+	other.Path = client.Path
+	other.Endpoint = client.Endpoint
+	other.ForcePathStyle = client.ForcePathStyle
+	other.SkipVerify = client.SkipVerify
+	return other
+}
+
+// Refresh replaces the underlying client with one using freshly loaded
+// credentials. The new client is verified with a listing request first and
+// the current client is kept if that fails. Credentials from a provider are
+// fetched again instead, replacing the client, and then verified.
+func (c *AuthClient) Refresh(ctx context.Context) error {
+	if c.creds != nil {
+		c.creds.Expire()
+		client, err := c.current()
+		if err != nil {
+			return err
+		}
+		_, err = client.Generations(ctx)
+		return err
+	}
+
+	client := cloneClient(c.Unwrap())
+	if _, err := client.Generations(ctx); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = client
+	return nil
+}
+
+// refreshCredentials refreshes the credentials of c on every interval until
+// ctx is done, so temporary credentials are renewed before they expire
+// rather than after a sync fails. Failed refreshes are retried with backoff.
+func refreshCredentials(ctx context.Context, c *AuthClient, interval time.Duration, b Backoff) {
+	wait := interval
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		startTime := time.Now()
+		if err := c.Refresh(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			replicaCredentialRefreshFailureCounter.Inc()
+			wait = b.Next()
+			log.Printf("cannot refresh replica credentials, retrying: replica=%s backoff=%s err=%s", c.name, wait, err)
+			continue
+		}
+
+		log.Printf("replica credentials refreshed: replica=%s elapsed=%s", c.name, time.Since(startTime).Round(time.Millisecond))
+		wait = interval
+		b.Reset()
+	}
+}
+
+func (c *AuthClient) succeeded() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.threshold > 0 && c.failures >= c.threshold {
+		log.Printf("replica authentication recovered: replica=%s", c.name)
+	}
+	c.failures = 0
+}
+
+// Type returns the type of the underlying client.
+func (c *AuthClient) Type() string { return lss3.ReplicaClientType }
+
+// Generations returns a list of available generations.
+func (c *AuthClient) Generations(ctx context.Context) (a []string, err error) {
+	err = c.do(true, func(client *lss3.ReplicaClient) (err error) {
+		a, err = client.Generations(ctx)
+		return err
+	})
+	return a, err
+}
+
+// DeleteGeneration deletes all snapshots & WAL segments within a generation.
+func (c *AuthClient) DeleteGeneration(ctx context.Context, generation string) error {
+	return c.do(true, func(client *lss3.ReplicaClient) error {
+		return client.DeleteGeneration(ctx, generation)
+	})
+}
+
+// Snapshots returns an iterator of all snapshots within a generation.
+func (c *AuthClient) Snapshots(ctx context.Context, generation string) (itr litestream.SnapshotIterator, err error) {
+	err = c.do(true, func(client *lss3.ReplicaClient) (err error) {
+		itr, err = client.Snapshots(ctx, generation)
+		return err
+	})
+	return itr, err
+}
+
+// WriteSnapshot writes LZ4 compressed snapshot data to the replica.
+func (c *AuthClient) WriteSnapshot(ctx context.Context, generation string, index int, r io.Reader) (info litestream.SnapshotInfo, err error) {
+	err = c.do(false, func(client *lss3.ReplicaClient) (err error) {
+		info, err = client.WriteSnapshot(ctx, generation, index, r)
+		return err
+	})
+	return info, err
+}
+
+// DeleteSnapshot deletes a snapshot with the given generation & index.
+func (c *AuthClient) DeleteSnapshot(ctx context.Context, generation string, index int) error {
+	return c.do(true, func(client *lss3.ReplicaClient) error {
+		return client.DeleteSnapshot(ctx, generation, index)
+	})
+}
+
+// SnapshotReader returns a reader for LZ4 compressed snapshot data.
+func (c *AuthClient) SnapshotReader(ctx context.Context, generation string, index int) (rc io.ReadCloser, err error) {
+	err = c.do(true, func(client *lss3.ReplicaClient) (err error) {
+		rc, err = client.SnapshotReader(ctx, generation, index)
+		return err
+	})
+	return rc, err
+}
+
+// WALSegments returns an iterator of all WAL segments within a generation.
+func (c *AuthClient) WALSegments(ctx context.Context, generation string) (itr litestream.WALSegmentIterator, err error) {
+	err = c.do(true, func(client *lss3.ReplicaClient) (err error) {
+		itr, err = client.WALSegments(ctx, generation)
+		return err
+	})
+	return itr, err
+}
+
+// WriteWALSegment writes an LZ4 compressed WAL segment at a given position.
+func (c *AuthClient) WriteWALSegment(ctx context.Context, pos litestream.Pos, r io.Reader) (info litestream.WALSegmentInfo, err error) {
+	err = c.do(false, func(client *lss3.ReplicaClient) (err error) {
+		info, err = client.WriteWALSegment(ctx, pos, r)
+		return err
+	})
+	if err == nil {
+		c.mu.Lock()
+		c.lastWriteAt = time.Now()
+		c.mu.Unlock()
+	}
+	return info, err
+}
+
+// DeleteWALSegments deletes WAL segments at the given positions.
+func (c *AuthClient) DeleteWALSegments(ctx context.Context, a []litestream.Pos) error {
+	return c.do(true, func(client *lss3.ReplicaClient) error {
+		return client.DeleteWALSegments(ctx, a)
+	})
+}
+
+// WALSegmentReader returns a reader for an LZ4 compressed WAL segment.
+func (c *AuthClient) WALSegmentReader(ctx context.Context, pos litestream.Pos) (rc io.ReadCloser, err error) {
+	err = c.do(true, func(client *lss3.ReplicaClient) (err error) {
+		rc, err = client.WALSegmentReader(ctx, pos)
+		return err
+	})
+	return rc, err
+}
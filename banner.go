@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// logConfig logs the effective configuration as a single key=value line so
+// the settings an instance is running with can be read from its logs. Secrets
+// are never logged: hook commands & URLs are redacted and only the source of
+// AWS credentials & the admin auth mode are included.
+func logConfig(config Config) {
+	var replicas []string
+	for _, rc := range config.allReplicas() {
+		s := fmt.Sprintf("%s:s3://%s", rc.Name, rc.Bucket)
+		if rc.Region != "" {
+			s += "@" + rc.Region
+		}
+		replicas = append(replicas, s)
+	}
+
+	// Only report where AWS credentials come from, never the values.
+	credentials := "default"
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		credentials = "env"
+	}
+
+	fields := []string{
+		"version=" + version,
+		"dsn=" + config.DSN,
+		"replicas=" + strings.Join(replicas, ","),
+		"aws_credentials=" + credentials,
+		"restore_from=" + config.RestoreFrom,
+		fmt.Sprintf("restore_fallback=%t", config.RestoreFallback),
+		"replica_conflict=" + config.ReplicaConflict,
+		fmt.Sprintf("restore_oldest=%t", config.RestoreOldest),
+		"restore_inconsistent=" + config.RestoreInconsistent,
+		fmt.Sprintf("frozen=%t", config.Frozen),
+		fmt.Sprintf("record_version=%t", config.RecordVersion),
+		fmt.Sprintf("generation_change_halt=%t", config.GenerationChangeHalt),
+		fmt.Sprintf("force_restore=%t", config.ForceRestore),
+		fmt.Sprintf("max_restore_age=%s", config.MaxRestoreAge),
+		fmt.Sprintf("restore_concurrency=%d", config.RestoreConcurrency),
+		fmt.Sprintf("ready_min_healthy_replicas=%d", config.ReadyMinHealthyReplicas),
+		"count_mode=" + config.CountMode,
+		"count_consistency=" + config.CountConsistency,
+		fmt.Sprintf("sync_interval=%s", config.SyncInterval),
+		fmt.Sprintf("monitor_interval=%s", config.MonitorInterval),
+		fmt.Sprintf("sync_coalesce_window=%s", config.SyncCoalesceWindow),
+		fmt.Sprintf("sync_backoff=%s-%s", config.SyncBackoffInitial, config.SyncBackoffMax),
+		fmt.Sprintf("sync_workers=%d", config.SyncWorkers),
+		fmt.Sprintf("sync_batching=%t", config.SyncBatching),
+		"tx_mode=" + config.TxMode,
+		fmt.Sprintf("cache_size=%d", config.CacheSize),
+		"temp_store=" + config.TempStore,
+		fmt.Sprintf("checkpoint_wait=%s", config.CheckpointWait),
+		fmt.Sprintf("file_check_interval=%s", config.FileCheckInterval),
+		fmt.Sprintf("heartbeat_interval=%s", config.HeartbeatInterval),
+		fmt.Sprintf("max_body_bytes=%d", config.MaxBodyBytes),
+		fmt.Sprintf("compress=%t", config.Compress),
+		fmt.Sprintf("shutdown_timeout=%s", config.ShutdownTimeout),
+		fmt.Sprintf("preshutdown_delay=%s", config.PreshutdownDelay),
+		fmt.Sprintf("check_on_shutdown=%t", config.CheckOnShutdown),
+		fmt.Sprintf("min_snapshot_interval=%s", config.MinSnapshotInterval),
+		fmt.Sprintf("verify_interval=%s", config.VerifyInterval),
+		"reload_file=" + config.ReloadFile,
+		"cloudwatch_namespace=" + config.CloudWatchNamespace,
+		"base_path=" + config.BasePath,
+		fmt.Sprintf("tls=%t", config.TLSCert != ""),
+		fmt.Sprintf("admin=%t", config.Admin),
+		"admin_auth=" + config.AdminAuth,
+		"read_during_restore=" + config.ReadDuringRestore,
+		fmt.Sprintf("dashboard=%t", config.Dashboard),
+		"post_restore_hook=" + redact(config.PostRestoreHook),
+		"admin_audit_log=" + config.AdminAuditLog,
+		"credentials_cmd=" + redact(config.CredentialsCmd),
+		"credentials_secret=" + config.CredentialsSecret,
+		"generation_hook_cmd=" + redact(config.GenerationHookCmd),
+		"generation_hook_url=" + redactURL(config.GenerationHookURL),
+	}
+	log.Printf("effective config: %s", strings.Join(fields, " "))
+}
+
+// redact hides a value that may contain secrets, only showing if it is set.
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// redactURL returns the scheme & host of rawurl. Credentials, paths and query
+// strings may contain tokens so they are left out.
+func redactURL(rawurl string) string {
+	if rawurl == "" {
+		return ""
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return "[redacted]"
+	}
+	return u.Scheme + "://" + u.Host + "/[redacted]"
+}
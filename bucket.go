@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Defaults for buckets created with -s3-create-bucket.
+const (
+	DefaultCreateBucketRegion = "us-east-1"
+	DefaultCreateBucketACL    = s3.BucketCannedACLPrivate
+)
+
+// createBucket creates bucket in region with the given canned ACL if it does
+// not exist yet. A bucket which already exists and is accessible is left
+// unchanged, whatever its region or ACL.
+func createBucket(ctx context.Context, bucket, region, acl string) error {
+	sess, err := session.NewSession(awsConfig(region))
+	if err != nil {
+		return fmt.Errorf("cannot create aws session: %w", err)
+	}
+	svc := s3.New(sess)
+
+	// Check first since CreateBucket succeeds for existing buckets in
+	// us-east-1, which would be reported as a creation.
+	var reqErr awserr.RequestFailure
+	if _, err := svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)}); err == nil {
+		return nil
+	} else if !errors.As(err, &reqErr) || reqErr.StatusCode() != http.StatusNotFound {
+		return fmt.Errorf("cannot check bucket %q: %w", bucket, err)
+	}
+
+	input := &s3.CreateBucketInput{
+		Bucket: aws.String(bucket),
+		ACL:    aws.String(acl),
+	}
+	if region != DefaultCreateBucketRegion {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(region)}
+	}
+
+	// Another instance may create the bucket at the same time.
+	if _, err := svc.CreateBucketWithContext(ctx, input); err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
+			return nil
+		}
+		return fmt.Errorf("cannot create bucket %q: %w", bucket, err)
+	}
+	log.Printf("created bucket: bucket=%s region=%s acl=%s", bucket, region, acl)
+	return nil
+}
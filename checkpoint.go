@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// CheckpointGate coordinates application writes with WAL checkpoints. When
+// enabled, Litestream's automatic checkpoints are disabled and checkpoints
+// are issued by Monitor instead. Writers call Wait before writing so they
+// yield to a running checkpoint, for up to MaxWait, rather than contending
+// with it and hitting SQLITE_BUSY.
+type CheckpointGate struct {
+	mu   sync.Mutex
+	done chan struct{} // non-nil while a checkpoint is running
+
+	MaxWait time.Duration
+}
+
+// NewCheckpointGate returns a new instance of CheckpointGate.
+func NewCheckpointGate(maxWait time.Duration) *CheckpointGate {
+	return &CheckpointGate{MaxWait: maxWait}
+}
+
+// Wait blocks while a checkpoint is running, up to MaxWait. Once MaxWait
+// passes the caller proceeds and contends with the checkpoint as usual.
+func (g *CheckpointGate) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	done := g.done
+	g.mu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+
+	startTime := time.Now()
+	timer := time.NewTimer(g.MaxWait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+	case <-timer.C:
+		checkpointWaitTimeoutCounter.Inc()
+	}
+	checkpointWaitSecondsHistogram.Observe(time.Since(startTime).Seconds())
+	return nil
+}
+
+// Checkpoint runs a checkpoint on lsdb while holding back new writes. The
+// duration is recorded by mode, including time spent waiting for the
+// database lock held by a running sync.
+func (g *CheckpointGate) Checkpoint(ctx context.Context, lsdb *litestream.DB, mode string) (err error) {
+	g.mu.Lock()
+	g.done = make(chan struct{})
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		close(g.done)
+		g.done = nil
+		g.mu.Unlock()
+	}()
+
+	startTime := time.Now()
+	defer func() {
+		checkpointSecondsHistogram.WithLabelValues(mode).Observe(time.Since(startTime).Seconds())
+		checkpointCounter.WithLabelValues(mode).Inc()
+		if err != nil {
+			checkpointErrorCounter.WithLabelValues(mode).Inc()
+		}
+	}()
+
+	return lsdb.Checkpoint(ctx, mode)
+}
+
+// Monitor checkpoints lsdb using the same thresholds as Litestream's default
+// automatic checkpointing until ctx is done. The interval is read on every
+// cycle so it can be changed while running.
+func (g *CheckpointGate) Monitor(ctx context.Context, lsdb *litestream.DB, interval func() time.Duration) {
+	lastCheckpoint := time.Now()
+	for {
+		timer := time.NewTimer(interval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// The offset within the current shadow WAL index approximates the
+		// number of frames written to the WAL since the last checkpoint.
+		pos, err := lsdb.Pos()
+		if err != nil || lsdb.PageSize() == 0 {
+			continue
+		}
+		frameN := int((pos.Offset - WALHeaderSize) / int64(WALFrameHeaderSize+lsdb.PageSize()))
+
+		var mode string
+		if frameN >= litestream.DefaultMaxCheckpointPageN {
+			mode = litestream.CheckpointModeRestart
+		} else if frameN >= litestream.DefaultMinCheckpointPageN {
+			mode = litestream.CheckpointModePassive
+		} else if frameN > 0 && time.Since(lastCheckpoint) > litestream.DefaultCheckpointInterval {
+			mode = litestream.CheckpointModePassive
+		} else {
+			continue
+		}
+
+		if err := g.Checkpoint(ctx, lsdb, mode); err != nil && ctx.Err() == nil {
+			log.Printf("cannot checkpoint: mode=%s err=%s", mode, err)
+			continue
+		}
+		lastCheckpoint = time.Now()
+	}
+}
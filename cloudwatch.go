@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/benbjohnson/litestream"
+)
+
+// DefaultCloudWatchInterval is the default time between CloudWatch publishes.
+const DefaultCloudWatchInterval = 1 * time.Minute
+
+// maxCloudWatchDatums is the number of metric data points CloudWatch accepts
+// in a single PutMetricData request.
+const maxCloudWatchDatums = 20
+
+// CloudWatchPublisher pushes replication metrics to CloudWatch custom metrics.
+type CloudWatchPublisher struct {
+	svc  *cloudwatch.CloudWatch
+	lsdb *litestream.DB
+	prev StatsTotals
+
+	// Namespace the metrics are published under.
+	Namespace string
+}
+
+// NewCloudWatchPublisher returns a publisher for lsdb's replicas. Requests
+// use awsCredentials, like the replicas. If region is empty, metrics are
+// published to the region of the primary replica's bucket.
+func NewCloudWatchPublisher(ctx context.Context, lsdb *litestream.DB, namespace, region string) (*CloudWatchPublisher, error) {
+	if region == "" {
+		var err error
+		if region, err = replicaRegion(ctx, lsdb.Replicas[0].Client.(*AuthClient).Unwrap()); err != nil {
+			return nil, fmt.Errorf("cannot determine cloudwatch region: %w", err)
+		}
+	}
+
+	sess, err := session.NewSession(awsConfig(region))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create aws session: %w", err)
+	}
+
+	return &CloudWatchPublisher{
+		svc:       cloudwatch.New(sess),
+		lsdb:      lsdb,
+		prev:      replicationStats.Totals(),
+		Namespace: namespace,
+	}, nil
+}
+
+// Monitor publishes metrics on every interval until ctx is done.
+func (p *CloudWatchPublisher) Monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := p.Publish(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("cannot publish cloudwatch metrics: %s", err)
+		}
+	}
+}
+
+// Publish sends the sync activity since the last publish and the current
+// lag of each replica.
+func (p *CloudWatchPublisher) Publish(ctx context.Context) error {
+	now := time.Now()
+	totals := replicationStats.Totals()
+	stats := totals.Sub(p.prev)
+
+	datums := []*cloudwatch.MetricDatum{
+		p.datum(now, "SyncCount", float64(stats.SyncN), cloudwatch.StandardUnitCount, ""),
+		p.datum(now, "SyncFailures", float64(stats.FailureN), cloudwatch.StandardUnitCount, ""),
+	}
+	if stats.SyncN > 0 {
+		datums = append(datums, p.datum(now, "SyncLatency", float64(stats.AvgSync())/float64(time.Millisecond), cloudwatch.StandardUnitMilliseconds, ""))
+	}
+
+	// Lag is the WAL data written locally but not yet synced to the replica.
+	for _, r := range p.lsdb.Replicas {
+		datums = append(datums, p.datum(now, "ReplicationLag", float64(pendingBytes(r)), cloudwatch.StandardUnitBytes, r.Name()))
+	}
+
+	for len(datums) > 0 {
+		n := len(datums)
+		if n > maxCloudWatchDatums {
+			n = maxCloudWatchDatums
+		}
+		if _, err := p.svc.PutMetricDataWithContext(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(p.Namespace),
+			MetricData: datums[:n],
+		}); err != nil {
+			return err
+		}
+		datums = datums[n:]
+	}
+
+	// Only advance once published so failed intervals are included next time.
+	p.prev = totals
+	return nil
+}
+
+// datum returns a metric data point, with a Replica dimension if set.
+func (p *CloudWatchPublisher) datum(t time.Time, name string, value float64, unit, replica string) *cloudwatch.MetricDatum {
+	d := &cloudwatch.MetricDatum{
+		MetricName: aws.String(name),
+		Timestamp:  aws.Time(t),
+		Unit:       aws.String(unit),
+		Value:      aws.Float64(value),
+	}
+	if replica != "" {
+		d.Dimensions = []*cloudwatch.Dimension{{Name: aws.String("Replica"), Value: aws.String(replica)}}
+	}
+	return d
+}
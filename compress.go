@@ -0,0 +1,134 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultCompressMinSize is the default response size below which responses
+// are sent uncompressed as gzip would save little or even grow them.
+const DefaultCompressMinSize = 1024
+
+// compress wraps h so responses of at least minSize bytes are gzip encoded
+// for clients which accept it. It must not wrap streaming handlers as the
+// response is held back until minSize bytes are written.
+func compress(h http.Handler, minSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize}
+		defer gw.Close()
+		h.ServeHTTP(gw, r)
+	}
+}
+
+// acceptsGzip returns true if the Accept-Encoding header allows gzip, either
+// by name or by wildcard, with a non-zero quality.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		if name := strings.TrimSpace(fields[0]); name != "gzip" && name != "*" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if v := strings.TrimSpace(param); strings.HasPrefix(v, "q=") {
+				if q, err := strconv.ParseFloat(v[2:], 64); err != nil || q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the response until minSize bytes are written
+// and then switches to gzip. Smaller responses are written as they are when
+// the writer is closed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	done    bool // true once the header has been sent
+}
+
+// WriteHeader holds the status code until it is known whether the response
+// is compressed.
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(p)
+	} else if w.done {
+		return w.ResponseWriter.Write(p)
+	} else if len(w.buf)+len(p) < w.minSize {
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+
+	// Large enough to compress. Handlers which set their own encoding are
+	// passed through as they are.
+	h := w.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(append(w.buf, p...)))
+	}
+	if h.Get("Content-Encoding") != "" {
+		if err := w.flushBuf(); err != nil {
+			return 0, err
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	w.writeHeader()
+
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	if _, err := w.gz.Write(w.buf); err != nil {
+		return 0, err
+	}
+	w.buf = nil
+	return w.gz.Write(p)
+}
+
+// Close finishes the gzip stream or writes out a response too small to
+// compress.
+func (w *gzipResponseWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return w.flushBuf()
+}
+
+// flushBuf sends the header and any buffered bytes uncompressed.
+func (w *gzipResponseWriter) flushBuf() error {
+	if w.done {
+		return nil
+	}
+	w.writeHeader()
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *gzipResponseWriter) writeHeader() {
+	w.done = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Count consistency models.
+const (
+	// Count is read within the write transaction. Always accurate.
+	CountConsistencyStrict = "strict"
+
+	// Count is read from an in-memory cache. Fast but may lag behind writes
+	// made by other processes until the next reload.
+	CountConsistencyEventual = "eventual"
+)
+
+// DefaultCountCacheReloadInterval is the time between reloads of the cached
+// count from the database.
+const DefaultCountCacheReloadInterval = 30 * time.Second
+
+// countQuery returns the query used to read the page view count.
+func countQuery(mode string) string {
+	if mode == CountModeCounter {
+		return `SELECT value FROM counters WHERE name = 'page_views';`
+	}
+	return `SELECT COUNT(1) FROM page_views;`
+}
+
+// CountCache holds an in-memory page view count for eventually consistent
+// reads. It is incremented on each local write and periodically reloaded from
+// the database to pick up writes made elsewhere.
+type CountCache struct {
+	n     int64 // accessed atomically
+	db    *sql.DB
+	query string
+}
+
+// NewCountCache returns a new instance of CountCache that loads its value
+// from db using the given count mode.
+func NewCountCache(db *sql.DB, mode string) *CountCache {
+	return &CountCache{db: db, query: countQuery(mode)}
+}
+
+// Load reads the current count from the database.
+func (c *CountCache) Load(ctx context.Context) error {
+	var n int64
+	if err := c.db.QueryRowContext(ctx, c.query).Scan(&n); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.n, n)
+	return nil
+}
+
+// Seed performs the initial load of the count. If the count does not finish
+// within timeout then an estimate based on the largest row id is used instead
+// so that startup is not blocked on huge tables. The estimate is corrected by
+// the next reload. A zero timeout waits for the count indefinitely.
+func (c *CountCache) Seed(ctx context.Context, timeout time.Duration) error {
+	if timeout <= 0 {
+		return c.Load(ctx)
+	}
+
+	loadCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := c.Load(loadCtx)
+	if err == nil || loadCtx.Err() != context.DeadlineExceeded || ctx.Err() != nil {
+		return err
+	}
+
+	// Row ids are assigned sequentially so the largest one approximates the
+	// row count, less any deleted rows. Reading it only touches one index page.
+	var n int64
+	if err := c.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(rowid), 0) FROM page_views;`).Scan(&n); err != nil {
+		return fmt.Errorf("cannot estimate count: %w", err)
+	}
+	atomic.StoreInt64(&c.n, n)
+	log.Printf("count did not finish within %s, using estimate until next reload: n=%d", timeout, n)
+	return nil
+}
+
+// Get returns the cached count.
+func (c *CountCache) Get() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// Add increments the cached count by delta and returns the new count.
+func (c *CountCache) Add(delta int64) int64 {
+	return atomic.AddInt64(&c.n, delta)
+}
+
+// Monitor reloads the count on an interval until ctx is done. Each reload is
+// canceled after timeout, in which case the cached count is kept until the
+// next reload. A zero timeout waits for each reload indefinitely.
+func (c *CountCache) Monitor(ctx context.Context, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.reload(ctx, timeout); err != nil && ctx.Err() == nil {
+				log.Printf("cannot reload cached count: %s", err)
+			}
+		}
+	}
+}
+
+// reload performs a single periodic reload, bounded by timeout.
+func (c *CountCache) reload(ctx context.Context, timeout time.Duration) error {
+	if timeout <= 0 {
+		return c.Load(ctx)
+	}
+
+	loadCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := c.Load(loadCtx)
+	if err == nil || loadCtx.Err() != context.DeadlineExceeded || ctx.Err() != nil {
+		return err
+	}
+	log.Printf("count reload did not finish within %s, keeping cached count: n=%d", timeout, c.Get())
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Ensure a periodic reload that exceeds its timeout keeps the cached count.
+func TestCountCache_reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	createTestPageViews(t, path, 5)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	c := NewCountCache(db, CountModeScan)
+	if err := c.reload(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	} else if n := c.Get(); n != 5 {
+		t.Fatalf("n=%d, want 5", n)
+	}
+
+	// Swap in a query that never finishes within the timeout.
+	c.Add(2)
+	c.query = `WITH RECURSIVE r(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM r) SELECT COUNT(1) FROM r;`
+	start := time.Now()
+	if err := c.reload(context.Background(), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	} else if n := c.Get(); n != 7 {
+		t.Fatalf("n=%d, want cached count 7", n)
+	} else if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("reload took %s, want it canceled", elapsed)
+	}
+}
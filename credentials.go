@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	lss3 "github.com/benbjohnson/litestream/s3"
+)
+
+// CredentialProviderTimeout is the maximum time allowed to fetch credentials.
+const CredentialProviderTimeout = 30 * time.Second
+
+// credentialExpiryWindow is how long before their expiration temporary
+// credentials are fetched again, so no request is signed with expired keys.
+const credentialExpiryWindow = 5 * time.Minute
+
+// Credentials are the AWS keys used for every AWS request. SessionToken &
+// Expiration are set for temporary credentials, such as from STS.
+type Credentials struct {
+	AccessKeyID     string     `json:"AccessKeyId"`
+	SecretAccessKey string     `json:"SecretAccessKey"`
+	SessionToken    string     `json:"SessionToken,omitempty"`
+	Expiration      *time.Time `json:"Expiration,omitempty"`
+}
+
+// CredentialProvider fetches replica credentials from a secrets backend, so
+// that secrets are not passed in process arguments or the environment.
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// parseCredentials decodes credentials from a JSON object such as
+// {"AccessKeyId":"...","SecretAccessKey":"...","SessionToken":"..."}, which
+// is also the output format of AWS credential processes. Key names are
+// matched case insensitively.
+func parseCredentials(data []byte) (Credentials, error) {
+	var creds Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return creds, fmt.Errorf("cannot parse credentials: %w", err)
+	} else if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return creds, fmt.Errorf("credentials must include AccessKeyId & SecretAccessKey")
+	}
+	return creds, nil
+}
+
+var _ CredentialProvider = (*CommandCredentialProvider)(nil)
+
+// CommandCredentialProvider runs a shell command which prints credentials as
+// JSON to stdout, e.g. a wrapper around the Vault CLI.
+type CommandCredentialProvider struct {
+	Command string
+}
+
+// Credentials runs the command and parses its output. Stderr is logged but
+// stdout never is since it holds the secret.
+func (p *CommandCredentialProvider) Credentials(ctx context.Context) (Credentials, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", p.Command)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if stderr.Len() > 0 {
+		log.Printf("credentials command output: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+	if err != nil {
+		return Credentials{}, fmt.Errorf("credentials command failed: %w", err)
+	}
+	return parseCredentials(stdout.Bytes())
+}
+
+var _ CredentialProvider = (*SecretsManagerCredentialProvider)(nil)
+
+// SecretsManagerCredentialProvider reads credentials from an AWS Secrets
+// Manager secret holding a JSON object. The secret itself is read with
+// AWSCredentials, or the default AWS credential chain if nil.
+type SecretsManagerCredentialProvider struct {
+	SecretID       string
+	Region         string
+	AWSCredentials *credentials.Credentials
+}
+
+// Credentials fetches the current version of the secret.
+func (p *SecretsManagerCredentialProvider) Credentials(ctx context.Context) (Credentials, error) {
+	cfg := &aws.Config{Credentials: p.AWSCredentials}
+	if p.Region != "" {
+		cfg.Region = aws.String(p.Region)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("cannot create aws session: %w", err)
+	}
+
+	out, err := secretsmanager.New(sess).GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(p.SecretID),
+	})
+	if err != nil {
+		return Credentials{}, fmt.Errorf("cannot read secret %q: %w", p.SecretID, err)
+	} else if out.SecretString == nil {
+		return Credentials{}, fmt.Errorf("secret %q has no string value", p.SecretID)
+	}
+	return parseCredentials([]byte(*out.SecretString))
+}
+
+// newCredentialProvider returns the provider configured by -credentials-cmd
+// or -credentials-secret, or nil if neither is set.
+func newCredentialProvider(config Config) CredentialProvider {
+	if config.CredentialsCmd != "" {
+		return &CommandCredentialProvider{Command: config.CredentialsCmd}
+	} else if config.CredentialsSecret != "" {
+		return &SecretsManagerCredentialProvider{SecretID: config.CredentialsSecret, Region: config.Region, AWSCredentials: startupCredentials()}
+	}
+	return nil
+}
+
+// startupCredentials returns the default AWS credential chain as it is before
+// replica credentials are exported to the environment. Otherwise the chain
+// would pick up the exported keys in place of, say, an instance role once its
+// credentials expire.
+func startupCredentials() *credentials.Credentials {
+	var providers []credentials.Provider
+	if v, err := (&credentials.EnvProvider{}).Retrieve(); err == nil {
+		providers = append(providers, &credentials.StaticProvider{Value: v})
+	}
+	for _, p := range defaults.CredProviders(defaults.Config(), defaults.Handlers()) {
+		if _, ok := p.(*credentials.EnvProvider); !ok {
+			providers = append(providers, p)
+		}
+	}
+	return credentials.NewCredentials(&credentials.ChainProvider{Providers: providers, VerboseErrors: true})
+}
+
+// awsCredentials are shared by every AWS session the app creates itself:
+// bucket creation, the restore semaphore & CloudWatch. Nil uses the default
+// AWS credential chain instead. Litestream's replica clients read the same
+// credentials from the environment, see exportCredentials.
+var awsCredentials *credentials.Credentials
+
+// credentialsVersion is incremented each time credentials are exported to the
+// environment. Accessed atomically.
+var credentialsVersion uint64
+
+// initCredentials sets awsCredentials from the provider configured by
+// -credentials-cmd or -credentials-secret, if any. The credentials are
+// fetched once upfront so a misconfigured provider fails startup.
+func initCredentials(config Config) error {
+	p := newCredentialProvider(config)
+	if p == nil {
+		return nil
+	}
+
+	creds := credentials.NewCredentials(&awsCredentialProvider{provider: p})
+	if _, err := creds.Get(); err != nil {
+		return err
+	}
+	awsCredentials = creds
+	return nil
+}
+
+// awsConfig returns the configuration for an AWS session in region using
+// awsCredentials. An empty region is read from the environment.
+func awsConfig(region string) *aws.Config {
+	cfg := &aws.Config{Credentials: awsCredentials}
+	if region != "" {
+		cfg.Region = aws.String(region)
+	}
+	return cfg
+}
+
+var _ credentials.Provider = (*awsCredentialProvider)(nil)
+
+// awsCredentialProvider adapts a CredentialProvider to the AWS SDK. The SDK
+// fetches credentials again once they reach their expiration, if any, or
+// after they are expired explicitly on an auth failure or refresh.
+type awsCredentialProvider struct {
+	provider  CredentialProvider
+	expiresAt time.Time // zero if the credentials do not expire
+}
+
+// Retrieve fetches the current credentials from the provider.
+func (p *awsCredentialProvider) Retrieve() (credentials.Value, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CredentialProviderTimeout)
+	defer cancel()
+
+	startTime := time.Now()
+	creds, err := p.provider.Credentials(ctx)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("cannot fetch replica credentials: %w", err)
+	}
+
+	p.expiresAt = time.Time{}
+	if creds.Expiration != nil {
+		p.expiresAt = creds.Expiration.Add(-credentialExpiryWindow)
+	}
+	log.Printf("replica credentials fetched: temporary=%t elapsed=%s", creds.SessionToken != "", time.Since(startTime).Round(time.Millisecond))
+
+	if err := exportCredentials(creds); err != nil {
+		return credentials.Value{}, err
+	}
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		ProviderName:    "myapp",
+	}, nil
+}
+
+// IsExpired returns true once temporary credentials are about to expire.
+func (p *awsCredentialProvider) IsExpired() bool {
+	return !p.expiresAt.IsZero() && time.Now().After(p.expiresAt)
+}
+
+// replicaRegion returns the region of client's bucket. If none is specified,
+// it is looked up as Litestream does. Endpoints are typically non-S3 object
+// stores which use the default region.
+func replicaRegion(ctx context.Context, client *lss3.ReplicaClient) (string, error) {
+	if client.Region != "" {
+		return client.Region, nil
+	} else if client.Endpoint != "" {
+		return lss3.DefaultRegion, nil
+	}
+
+	sess, err := session.NewSession(awsConfig(lss3.DefaultRegion))
+	if err != nil {
+		return "", fmt.Errorf("cannot create aws session: %w", err)
+	}
+	region, err := s3manager.GetBucketRegion(ctx, sess, client.Bucket, lss3.DefaultRegion)
+	if err != nil {
+		return "", fmt.Errorf("cannot lookup bucket region: %w", err)
+	}
+	return region, nil
+}
+
+// exportCredentials sets creds in the environment variables read by the
+// default AWS credential chain. Litestream's S3 client only accepts a static
+// key & secret, which cannot carry a session token, so its replica clients
+// use the default chain instead. Clients only read the environment when they
+// are initialized so AuthClient replaces them once credentialsVersion changes.
+// Child processes, such as hooks, inherit the exported credentials.
+func exportCredentials(creds Credentials) error {
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     creds.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY": creds.SecretAccessKey,
+		"AWS_SESSION_TOKEN":     creds.SessionToken,
+	} {
+		if err := os.Setenv(k, v); err != nil {
+			return fmt.Errorf("cannot export replica credentials: %w", err)
+		}
+	}
+	atomic.AddUint64(&credentialsVersion, 1)
+	return nil
+}
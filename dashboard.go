@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// DefaultDashboardGenerationLimit is the default number of generations listed
+// by the dashboard.
+const DefaultDashboardGenerationLimit = 100
+
+// DashboardStatus is the data shown on the dashboard.
+type DashboardStatus struct {
+	Count       int64              `json:"count"`
+	Generation  string             `json:"generation"`
+	Generations []string           `json:"generations"`
+	GenerationN int                `json:"generationN"`
+	Replicas    []DashboardReplica `json:"replicas"`
+}
+
+// DashboardReplica is the replication status of a single replica.
+type DashboardReplica struct {
+	Name        string     `json:"name"`
+	Pos         string     `json:"pos"`
+	LastWriteAt *time.Time `json:"lastWriteAt,omitempty"`
+}
+
+// handleDashboard serves a self-contained HTML page which polls
+// /dashboard/status and renders it. The status URL is relative so the page
+// also works under -base-path, whether or not the proxy strips the prefix.
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, dashboardHTML)
+}
+
+// handleDashboardStatus returns the dashboard data as JSON.
+func (s *Server) handleDashboardStatus(w http.ResponseWriter, r *http.Request) {
+	var status DashboardStatus
+
+	if s.CountCache != nil {
+		status.Count = s.CountCache.Get()
+	} else if err := s.DB.QueryRowContext(r.Context(), countQuery(s.Config.CountMode)).Scan(&status.Count); err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// A frozen server always serves its restored generation.
+	generation := s.frozenPos().Generation
+	if !s.Config.Frozen {
+		var err error
+		if generation, err = s.LSDB.CurrentGeneration(); err != nil {
+			Error(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	status.Generation = generation
+
+	// List generations from the replica that restores are performed from.
+	if replica := s.LSDB.Replica(s.Config.RestoreFrom); replica != nil {
+		generations, err := replica.Client.Generations(r.Context())
+		if err != nil {
+			Error(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		updatedAt, err := s.generationTimes.UpdatedAt(r.Context(), replica, generations, generation)
+		if err != nil {
+			Error(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		status.GenerationN = len(generations)
+		status.Generations = limitGenerations(generations, generation, updatedAt, s.Config.DashboardGenerationLimit)
+	}
+
+	for _, replica := range s.LSDB.Replicas {
+		info := DashboardReplica{Name: replica.Name(), Pos: replica.Pos().String()}
+		if c, ok := replica.Client.(*AuthClient); ok {
+			if t := c.LastWriteAt(); !t.IsZero() {
+				info.LastWriteAt = &t
+			}
+		}
+		status.Replicas = append(status.Replicas, info)
+	}
+
+	JSON(w, r, status)
+}
+
+// limitGenerations returns a sorted copy of at most limit generations, with
+// the current generation always listed first and the rest most recently
+// updated first. A bucket with a long history can hold thousands of
+// generations which are too many to render on every refresh. A limit of zero
+// returns all generations.
+func limitGenerations(generations []string, current string, updatedAt map[string]time.Time, limit int) []string {
+	a := make([]string, len(generations))
+	copy(a, generations)
+	sort.Slice(a, func(i, j int) bool {
+		if (a[i] == current) != (a[j] == current) {
+			return a[i] == current
+		} else if ti, tj := updatedAt[a[i]], updatedAt[a[j]]; !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return a[i] < a[j]
+	})
+	if limit > 0 && len(a) > limit {
+		a = a[:limit]
+	}
+	return a
+}
+
+// generationTimes caches the last update time of each generation listed by
+// the dashboard. Finding it takes a snapshot & a WAL listing per generation,
+// which is too slow to repeat for thousands of generations on each refresh.
+// Only the current generation is still written to, so it is the only one
+// looked up again.
+type generationTimes struct {
+	mu sync.Mutex
+	m  map[string]time.Time
+}
+
+// UpdatedAt returns the last update time of each of generations on replica.
+// Generations no longer listed are dropped from the cache.
+func (c *generationTimes) UpdatedAt(ctx context.Context, replica *litestream.Replica, generations []string, current string) (map[string]time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := make(map[string]time.Time, len(generations))
+	for _, generation := range generations {
+		if t, ok := c.m[generation]; ok && generation != current {
+			m[generation] = t
+			continue
+		}
+
+		_, updatedAt, err := replica.GenerationTimeBounds(ctx, generation)
+		if err != nil {
+			return nil, err
+		}
+		m[generation] = updatedAt
+	}
+	c.m = m // replaced rather than modified so callers may keep reading m
+	return m, nil
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Litestream Dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { text-align: left; padding: 0.3em 1em 0.3em 0; }
+#count { font-size: 3em; font-weight: bold; }
+#error { color: #b00; }
+code { font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Litestream Dashboard</h1>
+<div id="error"></div>
+<div id="count">-</div>
+<p>page views</p>
+
+<h2>Replication</h2>
+<table>
+<tr><th>Current generation</th><td><code id="generation">-</code></td></tr>
+</table>
+<table id="replicas">
+<tr><th>Replica</th><th>Position</th><th>Last write</th></tr>
+</table>
+
+<h2>Available generations</h2>
+<ul id="generations"></ul>
+
+<script>
+function ago(t) {
+	if (!t) return "never";
+	var s = Math.round((Date.now() - new Date(t).getTime()) / 1000);
+	return new Date(t).toLocaleString() + " (" + s + "s ago)";
+}
+
+function cell(row, text) {
+	var td = document.createElement("td");
+	td.textContent = text;
+	row.appendChild(td);
+}
+
+function refresh() {
+	fetch("dashboard/status").then(function(resp) {
+		if (!resp.ok) throw new Error("status " + resp.status);
+		return resp.json();
+	}).then(function(status) {
+		document.getElementById("error").textContent = "";
+		document.getElementById("count").textContent = status.count;
+		document.getElementById("generation").textContent = status.generation || "-";
+
+		var table = document.getElementById("replicas");
+		while (table.rows.length > 1) table.deleteRow(1);
+		(status.replicas || []).forEach(function(r) {
+			var row = table.insertRow();
+			cell(row, r.name);
+			cell(row, r.pos);
+			cell(row, ago(r.lastWriteAt));
+		});
+
+		var list = document.getElementById("generations");
+		list.innerHTML = "";
+		(status.generations || []).forEach(function(g) {
+			var li = document.createElement("li");
+			li.textContent = g + (g === status.generation ? " (current)" : "");
+			list.appendChild(li);
+		});
+		var more = status.generationN - (status.generations || []).length;
+		if (more > 0) {
+			var li = document.createElement("li");
+			li.textContent = "and " + more + " more";
+			list.appendChild(li);
+		}
+	}).catch(function(err) {
+		document.getElementById("error").textContent = "Cannot load status: " + err.message;
+	});
+}
+
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
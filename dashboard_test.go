@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/file"
+)
+
+func TestLimitGenerations(t *testing.T) {
+	const n = 5000
+
+	// Generation names are random so their order says nothing about age.
+	// Name i was last updated i minutes ago.
+	base := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	generations := make([]string, n)
+	updatedAt := make(map[string]time.Time, n)
+	for i, j := range rand.Perm(n) {
+		generations[i] = fmt.Sprintf("%016x", j)
+		updatedAt[generations[i]] = base.Add(-time.Duration(j) * time.Minute)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		current int
+		limit   int
+		want    int
+	}{
+		{"Limit", 4321, 100, 100},
+		{"LimitOne", 4321, 1, 1},
+		{"NoLimit", 4321, 0, n},
+		{"LimitAboveCount", 4321, n + 1, n},
+		{"CurrentMostRecent", 0, 100, 100},
+		{"CurrentOldest", n - 1, 100, 100},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			input := append([]string(nil), generations...)
+			current := fmt.Sprintf("%016x", tt.current)
+
+			a := limitGenerations(input, current, updatedAt, tt.limit)
+			if len(a) != tt.want {
+				t.Fatalf("len=%d, want %d", len(a), tt.want)
+			} else if a[0] != current {
+				t.Fatalf("first=%s, want current generation %s", a[0], current)
+			}
+
+			// The remaining generations are the most recently updated, newest first.
+			for i, want := 1, 0; i < len(a); i, want = i+1, want+1 {
+				if want == tt.current {
+					want++
+				}
+				if a[i] != fmt.Sprintf("%016x", want) {
+					t.Fatalf("generations[%d]=%s, want %016x", i, a[i], want)
+				}
+			}
+
+			// The caller's listing is left as it was.
+			for i := range input {
+				if input[i] != generations[i] {
+					t.Fatalf("input reordered at %d", i)
+				}
+			}
+		})
+	}
+
+	// A current generation missing from the replica, e.g. before the first
+	// sync, leaves the listing ordered by update time.
+	t.Run("CurrentNotListed", func(t *testing.T) {
+		a := limitGenerations(generations, "ffffffffffffffff", updatedAt, 3)
+		if want := []string{"0000000000000000", "0000000000000001", "0000000000000002"}; !equalStrings(a, want) {
+			t.Fatalf("generations=%v, want %v", a, want)
+		}
+	})
+
+	// Generations updated at the same time are ordered by name.
+	t.Run("Ties", func(t *testing.T) {
+		a := limitGenerations([]string{"0000000000000002", "0000000000000001", "0000000000000003"}, "0000000000000003", nil, 0)
+		if want := []string{"0000000000000003", "0000000000000001", "0000000000000002"}; !equalStrings(a, want) {
+			t.Fatalf("generations=%v, want %v", a, want)
+		}
+	})
+}
+
+func TestServer_handleDashboardStatus_Generations(t *testing.T) {
+	const n = 2000
+	replica, client := newTestReplica(t)
+	counting := &countingReplicaClient{ReplicaClient: client}
+	replica.Client = counting
+	lsdb := replica.DB()
+	lsdb.Replicas = append(lsdb.Replicas, replica)
+
+	// Name j was last updated j minutes ago, written in random order.
+	now := time.Now().Truncate(time.Second)
+	for _, j := range rand.Perm(n) {
+		writeTestWALSegment(t, client, fmt.Sprintf("%016x", j), 0, now.Add(-time.Duration(j)*time.Minute))
+	}
+
+	// Make an old generation current so it is listed first regardless.
+	current := fmt.Sprintf("%016x", n-10)
+	if err := os.MkdirAll(filepath.Dir(lsdb.GenerationNamePath()), 0777); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(lsdb.GenerationNamePath(), []byte(current+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", lsdb.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE page_views (id INTEGER PRIMARY KEY, timestamp TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Config: Config{RestoreFrom: replica.Name(), DashboardGenerationLimit: 100},
+		DB:     db,
+		LSDB:   lsdb,
+	}
+	status := func() DashboardStatus {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.handleDashboardStatus(w, httptest.NewRequest("GET", "/dashboard/status", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+		}
+		var status DashboardStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	st := status()
+	if st.GenerationN != n {
+		t.Fatalf("generationN=%d, want %d", st.GenerationN, n)
+	} else if len(st.Generations) != 100 {
+		t.Fatalf("len(generations)=%d, want 100", len(st.Generations))
+	} else if st.Generation != current || st.Generations[0] != current {
+		t.Fatalf("generation=%s first=%s, want %s", st.Generation, st.Generations[0], current)
+	}
+	for i := 1; i < len(st.Generations); i++ {
+		if want := fmt.Sprintf("%016x", i-1); st.Generations[i] != want {
+			t.Fatalf("generations[%d]=%s, want most recently updated %s", i, st.Generations[i], want)
+		}
+	}
+	if counting.walSegmentsN != n {
+		t.Fatalf("WAL listings=%d, want one per generation", counting.walSegmentsN)
+	}
+
+	// Later refreshes only look up new generations & the current one.
+	writeTestWALSegment(t, client, "ffffffffffffffff", 0, now.Add(time.Minute))
+	counting.walSegmentsN = 0
+	if st := status(); st.GenerationN != n+1 {
+		t.Fatalf("generationN=%d, want %d", st.GenerationN, n+1)
+	} else if st.Generations[1] != "ffffffffffffffff" {
+		t.Fatalf("generations[1]=%s, want new generation", st.Generations[1])
+	} else if counting.walSegmentsN != 2 {
+		t.Fatalf("WAL listings=%d, want 2", counting.walSegmentsN)
+	}
+}
+
+// countingReplicaClient wraps a file replica client and counts WAL segment
+// listings.
+type countingReplicaClient struct {
+	*file.ReplicaClient
+	walSegmentsN int
+}
+
+func (c *countingReplicaClient) WALSegments(ctx context.Context, generation string) (litestream.WALSegmentIterator, error) {
+	c.walSegmentsN++
+	return c.ReplicaClient.WALSegments(ctx, generation)
+}
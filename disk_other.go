@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "errors"
+
+// availableSpace is not supported on this platform.
+func availableSpace(path string) (int64, error) {
+	return 0, errors.New("free space check not supported on this platform")
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import "syscall"
+
+// availableSpace returns the number of bytes available to unprivileged users
+// on the filesystem containing path.
+func availableSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
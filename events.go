@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Event broadcaster limits.
+const (
+	DefaultEventsMaxClients = 16
+
+	// Number of events buffered per client before events are dropped.
+	eventBufferSize = 64
+)
+
+// replicationEvents broadcasts replication activity to /events clients.
+var replicationEvents = NewBroadcaster()
+
+// Event is a server-sent event.
+type Event struct {
+	Name string
+	Data string
+}
+
+// Broadcaster fans out events to subscribed clients. Publishing never blocks:
+// a client that falls behind has events dropped rather than holding up
+// replication.
+type Broadcaster struct {
+	mu      sync.Mutex
+	clients map[chan Event]struct{}
+
+	MaxClients int
+}
+
+// NewBroadcaster returns a new instance of Broadcaster.
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{
+		clients:    make(map[chan Event]struct{}),
+		MaxClients: DefaultEventsMaxClients,
+	}
+}
+
+// Subscribe returns a channel that receives published events. Returns nil if
+// the maximum number of clients are already subscribed.
+func (b *Broadcaster) Subscribe() chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.clients) >= b.MaxClients {
+		return nil
+	}
+	ch := make(chan Event, eventBufferSize)
+	b.clients[ch] = struct{}{}
+	return ch
+}
+
+// Unsubscribe removes ch from the set of subscribed clients.
+func (b *Broadcaster) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.clients, ch)
+}
+
+// Publish sends an event to all subscribed clients.
+func (b *Broadcaster) Publish(name, format string, args ...interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.clients) == 0 {
+		return
+	}
+
+	event := Event{Name: name, Data: fmt.Sprintf(format, args...)}
+	for ch := range b.clients {
+		select {
+		case ch <- event:
+		default:
+			eventsDroppedCounter.Inc()
+		}
+	}
+}
+
+// handleEvents streams replication activity as server-sent events until the
+// client disconnects.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	ch := replicationEvents.Subscribe()
+	if ch == nil {
+		Error(w, r, fmt.Errorf("too many event stream clients"), http.StatusServiceUnavailable)
+		return
+	}
+	defer replicationEvents.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-ch:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name, event.Data)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
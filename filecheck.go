@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultFileCheckInterval is the default time between file size checks.
+const DefaultFileCheckInterval = 1 * time.Minute
+
+// SQLite file format constants.
+const (
+	dbHeaderSize = 100
+
+	walMagicLE    = 0x377f0682
+	walMagicBE    = 0x377f0683
+	walFileFormat = 3007000
+)
+
+// monitorFiles periodically runs checkFiles against the database at path.
+// The server is reported unhealthy while an anomaly is detected.
+func monitorFiles(ctx context.Context, s *Server, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := checkFiles(path)
+		if err != nil {
+			fileAnomalyGauge.Set(1)
+			log.Printf("database file anomaly detected: %s", err)
+		} else {
+			fileAnomalyGauge.Set(0)
+		}
+		s.SetHealthy(err == nil)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkFiles is a cheap heuristic for truncation & corruption. It verifies
+// that the database size is a multiple of its page size and that the WAL
+// header, if any, is valid and matches the database's page size. It is not a
+// substitute for PRAGMA integrity_check.
+func checkFiles(path string) error {
+	pageSize, err := checkDBFile(path)
+	if err != nil || pageSize == 0 {
+		return err
+	}
+	return checkWALFile(path+"-wal", pageSize)
+}
+
+// maxQuickCheckErrors is the number of problems reported by quickCheck.
+const maxQuickCheckErrors = 10
+
+// quickCheck runs PRAGMA quick_check against the database at path on a
+// separate read-only connection and returns an error listing the problems
+// found, if any. Unlike checkFiles, it reads every page so it can take a
+// while on a large database.
+func quickCheck(ctx context.Context, path string) error {
+	db, err := sql.Open("sqlite3", path+"?_query_only=true")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`PRAGMA quick_check(%d);`, maxQuickCheckErrors))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return err
+		} else if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	} else if len(problems) > 0 {
+		return fmt.Errorf("quick check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkDBFile returns the page size of the database. Returns zero if the
+// database is empty.
+func checkDBFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	} else if fi.Size() == 0 {
+		return 0, nil
+	}
+
+	hdr := make([]byte, dbHeaderSize)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return 0, fmt.Errorf("cannot read database header: %w", err)
+	}
+
+	// The page size is stored as a big-endian uint16 where 1 means 65536.
+	pageSize := int(binary.BigEndian.Uint16(hdr[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return 0, fmt.Errorf("invalid database page size: %d", pageSize)
+	} else if fi.Size()%int64(pageSize) != 0 {
+		return 0, fmt.Errorf("database size %d is not a multiple of page size %d", fi.Size(), pageSize)
+	}
+	return pageSize, nil
+}
+
+// checkWALFile validates the WAL header, if the WAL exists and is non-empty.
+func checkWALFile(path string, pageSize int) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	} else if fi.Size() == 0 {
+		return nil
+	}
+
+	hdr := make([]byte, WALHeaderSize)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return fmt.Errorf("cannot read wal header: %w", err)
+	}
+
+	if magic := binary.BigEndian.Uint32(hdr[0:4]); magic != walMagicLE && magic != walMagicBE {
+		return fmt.Errorf("invalid wal magic: %08x", magic)
+	} else if version := binary.BigEndian.Uint32(hdr[4:8]); version != walFileFormat {
+		return fmt.Errorf("invalid wal file format version: %d", version)
+	} else if walPageSize := int(binary.BigEndian.Uint32(hdr[8:12])); walPageSize != pageSize {
+		return fmt.Errorf("wal page size %d does not match database page size %d", walPageSize, pageSize)
+	}
+	return nil
+}
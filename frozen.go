@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// runFrozen restores the generation & index given by -generation and
+// -restore-index and serves it read-only until ctx is done. The restore is
+// written to a new temporary file on every start, so the local database at
+// -dsn is never read or modified and every run serves exactly the same
+// state. Nothing is replicated, checkpointed or written.
+func runFrozen(ctx context.Context, config Config, tlsConfig *tls.Config, adminAuth *AdminAuth) error {
+	// The replicas are only used to restore from and are never opened.
+	lsdb, err := newDB(ctx, config)
+	if err != nil {
+		return err
+	}
+	replica := lsdb.Replica(config.RestoreFrom)
+	if replica == nil {
+		return fmt.Errorf("replica not found for -restore-from: %q", config.RestoreFrom)
+	} else if err := validateRestoreIndex(ctx, replica, config.RestoreGeneration, config.RestoreIndex); err != nil {
+		return fmt.Errorf("invalid -restore-index: %w", err)
+	}
+
+	// Restore into a temporary directory on the same volume as the database.
+	dir, err := os.MkdirTemp(filepath.Dir(config.DSN), ".frozen-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath = filepath.Join(dir, "db")
+	opt.Generation = config.RestoreGeneration
+	opt.Index = config.RestoreIndex
+	opt.Logger = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
+
+	fmt.Printf("restoring frozen replica %q for generation %s to index %08x\n", replica.Name(), opt.Generation, opt.Index)
+	if err := replica.Restore(ctx, opt); err != nil {
+		return fmt.Errorf("cannot restore frozen database: %w", err)
+	} else if err := os.Chmod(opt.OutputPath, 0444); err != nil {
+		return err
+	}
+
+	// Open as immutable so SQLite never writes to or locks the file.
+	db, err := sql.Open("sqlite3", "file:"+opt.OutputPath+"?mode=ro&immutable=1&_query_only=true")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Serve without replicas. Counts are read from the database as there
+	// are no writes for a cache to follow.
+	config.CountConsistency = CountConsistencyStrict
+	config.WriteOnGet = false
+	s := NewServer(config, db, litestream.NewDB(opt.OutputPath))
+	s.AdminAuth = adminAuth
+	s.SetReady(true)
+
+	httpServer := &http.Server{Addr: addr, Handler: s, TLSConfig: tlsConfig}
+	if config.TLSCert != "" {
+		fmt.Printf("listening on %s (https, frozen)\n", addr)
+		go httpServer.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+	} else {
+		fmt.Printf("listening on %s (frozen)\n", addr)
+		go httpServer.ListenAndServe()
+	}
+
+	// Wait for signal.
+	<-ctx.Done()
+	log.Print("myapp received signal, shutting down")
+	if config.PreshutdownDelay > 0 {
+		preshutdown(s, config.PreshutdownDelay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), settings.ShutdownTimeout())
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("cannot shut down http server: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// Ensure a frozen server reports its restore point instead of the position
+// of its unopened database.
+func TestServer_Frozen_Pos(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	createTestPageViews(t, path, 3)
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_query_only=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s := NewServer(Config{
+		Frozen:            true,
+		Dashboard:         true,
+		RestoreGeneration: "0123456789abcdef",
+		RestoreIndex:      42,
+	}, db, litestream.NewDB(path))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/pos", nil))
+	var pos PosStatus
+	if w.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	} else if err := json.NewDecoder(w.Body).Decode(&pos); err != nil {
+		t.Fatal(err)
+	} else if want := "0123456789abcdef/0000002a:0"; pos.Pos != want {
+		t.Fatalf("pos=%q, want %q", pos.Pos, want)
+	} else if len(pos.Replicas) != 0 {
+		t.Fatalf("replicas=%v, want none", pos.Replicas)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard/status", nil))
+	var status DashboardStatus
+	if w.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	} else if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	} else if status.Generation != "0123456789abcdef" {
+		t.Fatalf("generation=%q, want frozen generation", status.Generation)
+	} else if status.Count != 3 {
+		t.Fatalf("count=%d, want 3", status.Count)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Filesystem magic numbers reported by statfs(2) for network & userspace
+// filesystems on which SQLite's locking is unreliable.
+var networkFilesystems = map[int64]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x564c:     "ncp",
+	0x5346414f: "afs",
+	0x73757245: "coda",
+	0x00c36400: "ceph",
+	0x01021997: "9p",
+	0x65735546: "fuse",
+}
+
+// localFilesystems names common local filesystems for logging.
+var localFilesystems = map[int64]string{
+	0xef53:     "ext4",
+	0x58465342: "xfs",
+	0x9123683e: "btrfs",
+	0x01021994: "tmpfs",
+	0x794c7630: "overlayfs",
+	0x2fc12fc1: "zfs",
+	0xf2f52010: "f2fs",
+}
+
+// filesystemType returns the name of the filesystem containing path and
+// whether it is a network filesystem.
+func filesystemType(path string) (name string, network bool, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return "", false, err
+	}
+
+	magic := int64(stat.Type) & 0xffffffff
+	if name, ok := networkFilesystems[magic]; ok {
+		return name, true, nil
+	} else if name, ok := localFilesystems[magic]; ok {
+		return name, false, nil
+	}
+	return fmt.Sprintf("unknown (0x%x)", magic), false, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// filesystemType is not supported on this platform.
+func filesystemType(path string) (name string, network bool, err error) {
+	return "", false, errors.New("filesystem detection not supported on this platform")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// DefaultGenerationHookDebounce is the default time to wait for the
+// generation to settle before running the hook.
+const DefaultGenerationHookDebounce = 10 * time.Second
+
+// GenerationNotifier runs a hook whenever the Litestream generation changes.
+// Changes are debounced so that rapid churn results in a single notification
+// for the latest generation once the debounce window has passed.
+type GenerationNotifier struct {
+	mu       sync.Mutex
+	current  string // last observed generation
+	reported string // generation last passed to the hook
+	timer    *time.Timer
+
+	// Shell command to execute. The new & previous generations are passed
+	// in the GENERATION & PREV_GENERATION environment variables.
+	Command string
+
+	// URL to POST a JSON event to.
+	URL string
+
+	// Time to wait after a change before running the hook.
+	Debounce time.Duration
+}
+
+// NewGenerationNotifier returns a new instance of GenerationNotifier.
+func NewGenerationNotifier() *GenerationNotifier {
+	return &GenerationNotifier{
+		Debounce: DefaultGenerationHookDebounce,
+	}
+}
+
+// Observe records the current generation. The first observed generation is
+// treated as the baseline and does not trigger the hook.
+func (n *GenerationNotifier) Observe(generation string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if generation == "" || generation == n.current {
+		return
+	} else if n.current == "" {
+		n.current, n.reported = generation, generation
+		return
+	}
+
+	n.current = generation
+	if n.timer == nil {
+		n.timer = time.AfterFunc(n.Debounce, n.fire)
+	}
+}
+
+// Monitor observes the database generation on an interval until ctx is done.
+// This catches changes that occur while no requests are being served. The
+// interval is read on every cycle so it can be changed while running.
+func (n *GenerationNotifier) Monitor(ctx context.Context, db *litestream.DB, interval func() time.Duration) {
+	for {
+		timer := time.NewTimer(interval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			if pos, err := db.Pos(); err == nil {
+				n.Observe(pos.Generation)
+			}
+		}
+	}
+}
+
+// fire runs the hook for the latest generation once the debounce window ends.
+func (n *GenerationNotifier) fire() {
+	n.mu.Lock()
+	prev, generation := n.reported, n.current
+	n.reported, n.timer = generation, nil
+	n.mu.Unlock()
+
+	// Ignore if the generation changed back during the debounce window.
+	if prev == generation {
+		return
+	}
+	log.Printf("generation changed: prev=%s new=%s", prev, generation)
+
+	if n.Command != "" {
+		if err := n.runCommand(prev, generation); err != nil {
+			log.Printf("generation hook command failed: %s", err)
+		}
+	}
+	if n.URL != "" {
+		if err := n.postWebhook(prev, generation); err != nil {
+			log.Printf("generation hook webhook failed: %s", err)
+		}
+	}
+}
+
+func (n *GenerationNotifier) runCommand(prev, generation string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", n.Command)
+	cmd.Env = append(os.Environ(), "GENERATION="+generation, "PREV_GENERATION="+prev)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("generation hook output: %s", bytes.TrimSpace(out))
+	}
+	return err
+}
+
+func (n *GenerationNotifier) postWebhook(prev, generation string) error {
+	body, err := json.Marshal(struct {
+		Generation     string    `json:"generation"`
+		PrevGeneration string    `json:"prevGeneration"`
+		Timestamp      time.Time `json:"timestamp"`
+	}{generation, prev, time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
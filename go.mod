@@ -3,6 +3,9 @@ module github.com/benbjohnson/litestream-library-example
 go 1.16
 
 require (
+	github.com/aws/aws-sdk-go v1.27.0
 	github.com/benbjohnson/litestream v0.3.8
 	github.com/mattn/go-sqlite3 v1.14.12
+	github.com/pierrec/lz4/v4 v4.1.3
+	github.com/prometheus/client_golang v1.9.0
 )
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// ErrWritesHalted is returned for writes after an unexpected generation change
+// when the guard is configured to halt.
+var ErrWritesHalted = errors.New("writes halted after unexpected generation change, restart required")
+
+// GenerationGuard detects generation changes that the application did not
+// initiate. Litestream starts a new generation when the WAL no longer matches
+// its shadow WAL, e.g. when another process checkpoints or writes to the same
+// database, which may mean two instances are replicating to the same path.
+type GenerationGuard struct {
+	mu        sync.Mutex
+	current   string // last observed generation
+	suspended bool   // true while an initiated change is in progress
+	halted    bool
+
+	// If true, writes are refused after an unexpected change.
+	Halt bool
+}
+
+// NewGenerationGuard returns a new instance of GenerationGuard.
+func NewGenerationGuard() *GenerationGuard {
+	return &GenerationGuard{}
+}
+
+// Observe records the current generation. The first observed generation is
+// treated as the baseline. Any later change is unexpected unless the guard
+// is suspended.
+func (g *GenerationGuard) Observe(generation string) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if generation == "" || generation == g.current {
+		return
+	} else if g.current == "" || g.suspended {
+		g.current = generation
+		return
+	}
+
+	prev := g.current
+	g.current = generation
+	unexpectedGenerationChangeCounter.Inc()
+	log.Printf("WARNING: unexpected generation change, another writer may be using the same database or replica path: prev=%s new=%s halt=%t", prev, generation, g.Halt)
+
+	if g.Halt && !g.halted {
+		g.halted = true
+		log.Printf("WARNING: writes halted until restart")
+	}
+}
+
+// Suspend stops reporting changes while the application changes the
+// generation itself, such as during a live restore.
+func (g *GenerationGuard) Suspend() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.suspended = true
+}
+
+// Resume accepts generation as the new baseline and reports changes again.
+func (g *GenerationGuard) Resume(generation string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.suspended = false
+	if generation != "" {
+		g.current = generation
+	}
+}
+
+// Check returns ErrWritesHalted if writes have been halted.
+func (g *GenerationGuard) Check() error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.halted {
+		return ErrWritesHalted
+	}
+	return nil
+}
+
+// Monitor observes the database generation on an interval until ctx is done
+// so changes are caught while no requests are being served.
+func (g *GenerationGuard) Monitor(ctx context.Context, db *litestream.DB, interval func() time.Duration) {
+	for {
+		timer := time.NewTimer(interval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			if pos, err := db.Pos(); err == nil {
+				g.Observe(pos.Generation)
+			}
+		}
+	}
+}
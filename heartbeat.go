@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// heartbeatSchema holds one row per host with the time of its last heartbeat.
+const heartbeatSchema = `CREATE TABLE IF NOT EXISTS heartbeats (host TEXT PRIMARY KEY, timestamp TEXT NOT NULL);`
+
+// monitorHeartbeat writes a heartbeat row every interval so the replica shows
+// recent activity even without traffic. External monitors can then alert if
+// restored data stops showing new heartbeats.
+func (s *Server) monitorHeartbeat(ctx context.Context, interval time.Duration) {
+	if _, err := s.DB.ExecContext(ctx, heartbeatSchema); err != nil {
+		log.Printf("cannot create heartbeat table, heartbeats disabled: %s", err)
+		return
+	}
+
+	host, _ := os.Hostname()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.heartbeat(ctx, host); err != nil && ctx.Err() == nil {
+			log.Printf("cannot write heartbeat: %s", err)
+		}
+	}
+}
+
+// heartbeat records a heartbeat for host and syncs it to the shadow WAL so
+// the replica monitors upload it. No heartbeat is written in maintenance mode.
+func (s *Server) heartbeat(ctx context.Context, host string) error {
+	// Skip while draining for maintenance, like page view writes.
+	if s.Maintenance() {
+		return nil
+	}
+
+	// Yield to a running checkpoint, if coordinated.
+	if s.CheckpointGate != nil {
+		if err := s.CheckpointGate.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	if err := s.GenerationGuard.Check(); err != nil {
+		return err
+	}
+
+	timestamp := formatTime(time.Now(), s.Config.LocalTime)
+	if _, err := s.DB.ExecContext(ctx, `INSERT INTO heartbeats (host, timestamp) VALUES (?, ?) ON CONFLICT (host) DO UPDATE SET timestamp = excluded.timestamp;`, host, timestamp); err != nil {
+		return err
+	}
+
+	if err := s.syncDB(ctx); err != nil {
+		return fmt.Errorf("cannot sync: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// Ensure no heartbeat is written while the server is in maintenance mode.
+func TestServer_heartbeat_Maintenance(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(heartbeatSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{DB: db}
+	s.SetMaintenance(true)
+	if err := s.heartbeat(context.Background(), "host"); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM heartbeats;`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("heartbeats=%d, want none in maintenance mode", n)
+	}
+}
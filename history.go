@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// DefaultRestoreHistorySize is the default number of restores retained.
+const DefaultRestoreHistorySize = 100
+
+// RestoreRecord describes a single completed restore.
+type RestoreRecord struct {
+	Time       time.Time `json:"time"`
+	Generation string    `json:"generation"`
+	Seconds    float64   `json:"seconds"`
+	Bytes      int64     `json:"bytes"`
+}
+
+// restoreHistoryPath returns the path of the restore history file for the
+// database at dsn. It sits next to the database so it survives restores,
+// which replace the database & Litestream's metadata directory.
+func restoreHistoryPath(dsn string) string {
+	return dsn + "-restores.json"
+}
+
+// appendRestoreHistory adds rec to the history file at path, keeping only the
+// newest max records, and returns the retained records.
+func appendRestoreHistory(path string, rec RestoreRecord, max int) ([]RestoreRecord, error) {
+	var records []RestoreRecord
+	if buf, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(buf, &records); err != nil {
+			log.Printf("cannot parse restore history, starting over: %s", err)
+			records = nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	records = append(records, rec)
+	if len(records) > max {
+		records = records[len(records)-max:]
+	}
+
+	// Write to a temporary file first so a crash cannot truncate the history.
+	buf, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return nil, err
+	} else if err := os.WriteFile(path+".tmp", buf, 0666); err != nil {
+		return nil, err
+	} else if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// summarizeRestoreHistory returns percentiles of restore duration & size.
+func summarizeRestoreHistory(records []RestoreRecord) string {
+	durations := make([]float64, len(records))
+	sizes := make([]float64, len(records))
+	for i, rec := range records {
+		durations[i], sizes[i] = rec.Seconds, float64(rec.Bytes)
+	}
+	sort.Float64s(durations)
+	sort.Float64s(sizes)
+
+	seconds := func(v float64) time.Duration {
+		return time.Duration(v * float64(time.Second)).Round(time.Millisecond)
+	}
+	return fmt.Sprintf("n=%d p50=%s p90=%s p99=%s max=%s bytes_p50=%d bytes_max=%d",
+		len(records),
+		seconds(percentile(durations, 0.50)),
+		seconds(percentile(durations, 0.90)),
+		seconds(percentile(durations, 0.99)),
+		seconds(durations[len(durations)-1]),
+		int64(percentile(sizes, 0.50)),
+		int64(sizes[len(sizes)-1]),
+	)
+}
+
+// percentile returns the nearest-rank percentile p of the sorted values.
+func percentile(values []float64, p float64) float64 {
+	i := int(math.Ceil(p*float64(len(values)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return values[i]
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Idempotency defaults.
+const (
+	DefaultIdempotencyTTL     = 10 * time.Minute
+	DefaultIdempotencyMaxKeys = 10000
+
+	// MaxIdempotencyKeyLen is the maximum length of an Idempotency-Key header.
+	MaxIdempotencyKeyLen = 255
+)
+
+// IdempotencyCache remembers the result of recent writes by their client
+// supplied idempotency key so that retried requests are not counted twice.
+// Keys are held in memory for TTL after the write commits. If more than
+// MaxKeys keys are held then the oldest are evicted early.
+type IdempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	lru     list.List // completed entries, oldest first
+
+	TTL     time.Duration
+	MaxKeys int
+}
+
+type idempotencyEntry struct {
+	key       string
+	n         int64
+	completed bool
+	expiresAt time.Time
+	elem      *list.Element
+	done      chan struct{} // closed when completed or canceled
+}
+
+// NewIdempotencyCache returns a new instance of IdempotencyCache.
+func NewIdempotencyCache() *IdempotencyCache {
+	return &IdempotencyCache{
+		entries: make(map[string]*idempotencyEntry),
+		TTL:     DefaultIdempotencyTTL,
+		MaxKeys: DefaultIdempotencyMaxKeys,
+	}
+}
+
+// Reserve returns the result of a previous write with key, if one committed
+// within the TTL. Otherwise the key is reserved and the caller must call
+// either Complete or Cancel. Concurrent requests for a reserved key wait for
+// the reservation to be released.
+func (c *IdempotencyCache) Reserve(ctx context.Context, key string) (n int64, found bool, err error) {
+	for {
+		c.mu.Lock()
+		c.removeExpired(time.Now())
+
+		e := c.entries[key]
+		if e == nil {
+			c.entries[key] = &idempotencyEntry{key: key, done: make(chan struct{})}
+			c.mu.Unlock()
+			return 0, false, nil
+		} else if e.completed {
+			c.mu.Unlock()
+			return e.n, true, nil
+		}
+		done := e.done
+		c.mu.Unlock()
+
+		// Wait for the in-flight request to finish and check again.
+		select {
+		case <-ctx.Done():
+			return 0, false, ctx.Err()
+		case <-done:
+		}
+	}
+}
+
+// Complete records n as the result for a reserved key.
+func (c *IdempotencyCache) Complete(key string, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entries[key]
+	if e == nil || e.completed {
+		return
+	}
+	e.n, e.completed = n, true
+	e.expiresAt = time.Now().Add(c.TTL)
+	e.elem = c.lru.PushBack(e)
+	close(e.done)
+
+	// Evict the oldest keys if over capacity.
+	for c.MaxKeys > 0 && c.lru.Len() > c.MaxKeys {
+		c.remove(c.lru.Front().Value.(*idempotencyEntry))
+	}
+}
+
+// Cancel releases a reserved key without recording a result, e.g. when the
+// write failed, so that a retry can perform the write.
+func (c *IdempotencyCache) Cancel(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e := c.entries[key]; e != nil && !e.completed {
+		delete(c.entries, key)
+		close(e.done)
+	}
+}
+
+// removeExpired removes completed entries whose TTL has passed. All entries
+// share the same TTL so they expire in the order they were completed.
+func (c *IdempotencyCache) removeExpired(now time.Time) {
+	for elem := c.lru.Front(); elem != nil; elem = c.lru.Front() {
+		e := elem.Value.(*idempotencyEntry)
+		if now.Before(e.expiresAt) {
+			return
+		}
+		c.remove(e)
+	}
+}
+
+func (c *IdempotencyCache) remove(e *idempotencyEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+}
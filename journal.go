@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Journal is an append-only log of page views. Each visit is written to the
+// journal and fsync'd before it is inserted into the database so that a crash
+// between the insert and the replica sync can be reconciled on restart.
+//
+// Entries are identified by the row id they will be inserted with. A visit is
+// recorded as "V <id> <timestamp>" and a visit whose transaction did not
+// commit is cancelled with "A <id>".
+//
+// The journal is only truncated on startup. On long-lived instances it can
+// be rotated by size into timestamped backups next to it, which are replayed
+// along with the journal.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	size int64 // current size of f
+	seq  int64 // last assigned row id
+
+	// Size at which the journal is rotated. Zero disables rotation.
+	MaxSize int64
+
+	// Number of rotated backups kept & maximum age of a backup. Older
+	// backups are deleted. Zero values keep all backups.
+	MaxBackups int
+	MaxAge     time.Duration
+}
+
+// OpenJournal opens the journal file at path, creating it if needed.
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{path: path, f: f}, nil
+}
+
+// Close closes the underlying journal file.
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
+
+// Reconcile inserts any journaled visits that are missing from the database
+// and then truncates the journal. Returns the number of visits replayed.
+// Must be called before Append.
+func (j *Journal) Reconcile(ctx context.Context, db *sql.DB) (n int, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// Read all visits that were not explicitly aborted, oldest file first.
+	backups, err := j.backups()
+	if err != nil {
+		return 0, err
+	}
+	visits := make(map[int64]string)
+	for _, path := range backups {
+		if err := j.readBackup(path, visits); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	} else if err := j.read(j.f, visits); err != nil {
+		return 0, err
+	}
+
+	// Insert visits which never made it into the database.
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for id, timestamp := range visits {
+		result, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO page_views (id, timestamp) VALUES (?, ?);`, id, timestamp)
+		if err != nil {
+			return 0, err
+		} else if rowsAffected, err := result.RowsAffected(); err != nil {
+			return 0, err
+		} else if rowsAffected > 0 {
+			n++
+		}
+	}
+
+	// Continue numbering after the highest row id in either the journal or the database.
+	var maxID sql.NullInt64
+	if err := tx.QueryRowContext(ctx, `SELECT MAX(id) FROM page_views;`).Scan(&maxID); err != nil {
+		return 0, err
+	} else if maxID.Int64 > j.seq {
+		j.seq = maxID.Int64
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	// All entries are now in the database so the journal can start over.
+	return n, j.truncate(backups)
+}
+
+// Reset discards every journaled visit and continues numbering after the
+// highest row id in db. It is called once the database contents have been
+// replaced, such as by a live restore, so that visits rolled back by it are
+// not replayed on the next startup. Appends must not run concurrently.
+func (j *Journal) Reset(ctx context.Context, db *sql.DB) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var maxID sql.NullInt64
+	if err := db.QueryRowContext(ctx, `SELECT MAX(id) FROM page_views;`).Scan(&maxID); err != nil {
+		return err
+	}
+
+	backups, err := j.backups()
+	if err != nil {
+		return err
+	} else if err := j.truncate(backups); err != nil {
+		return err
+	}
+	j.seq = maxID.Int64
+	return nil
+}
+
+// truncate deletes the rotated journals at backups and empties the journal.
+func (j *Journal) truncate(backups []string) error {
+	for _, path := range backups {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	} else if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	j.size = 0
+	return j.f.Sync()
+}
+
+// readBackup reads the visits from the rotated journal at path into visits.
+func (j *Journal) readBackup(path string, visits map[int64]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return j.read(f, visits)
+}
+
+// read adds visits from r to visits, removes aborted visits and advances the
+// sequence past every id seen.
+func (j *Journal) read(r io.Reader, visits map[int64]string) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue // ignore partially written line
+		}
+		id, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid journal entry: %q", scanner.Text())
+		}
+
+		switch fields[0] {
+		case "V":
+			if len(fields) < 3 {
+				continue
+			} else if _, err := time.Parse(time.RFC3339, fields[2]); err != nil {
+				continue // ignore partially written timestamp
+			}
+			visits[id] = fields[2]
+		case "A":
+			delete(visits, id)
+		}
+
+		if id > j.seq {
+			j.seq = id
+		}
+	}
+	return scanner.Err()
+}
+
+// Append records a visit and returns the row id it should be inserted with.
+func (j *Journal) Append(timestamp string) (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	id := j.seq + 1
+	n, err := fmt.Fprintf(j.f, "V %d %s\n", id, timestamp)
+	j.size += int64(n)
+	if err != nil {
+		return 0, err
+	} else if err := j.f.Sync(); err != nil {
+		return 0, err
+	}
+	j.seq = id
+
+	// Rotate once the visit is durable. A failed rotation only delays it.
+	if j.MaxSize > 0 && j.size >= j.MaxSize {
+		if err := j.rotate(); err != nil {
+			log.Printf("cannot rotate journal: %s", err)
+		}
+	}
+	return id, nil
+}
+
+// Abort records that the visit with the given id was not committed so it is
+// not replayed on restart.
+func (j *Journal) Abort(id int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	n, err := fmt.Fprintf(j.f, "A %d\n", id)
+	j.size += int64(n)
+	return err
+}
+
+// rotate renames the journal to a timestamped backup, starts a new journal and
+// deletes backups beyond MaxBackups or older than MaxAge. Deleted backups can
+// no longer be replayed.
+func (j *Journal) rotate() error {
+	f, err := os.OpenFile(j.path+".new", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	backup := j.path + "." + time.Now().UTC().Format(journalBackupTimeFormat)
+	if err := os.Rename(j.path, backup); err != nil {
+		f.Close()
+		return err
+	} else if err := os.Rename(j.path+".new", j.path); err != nil {
+		f.Close()
+		return err
+	}
+	j.f.Close()
+	j.f, j.size = f, 0
+	log.Printf("journal rotated: backup=%s", backup)
+
+	backups, err := j.backups()
+	if err != nil {
+		return err
+	}
+	for i, path := range backups {
+		expired := false
+		if j.MaxBackups > 0 && i < len(backups)-j.MaxBackups {
+			expired = true
+		} else if fi, err := os.Stat(path); err == nil && j.MaxAge > 0 && time.Since(fi.ModTime()) > j.MaxAge {
+			expired = true
+		}
+		if !expired {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("journal backup deleted: path=%s", path)
+	}
+	return nil
+}
+
+// journalBackupTimeFormat names rotated journals so they sort by age.
+const journalBackupTimeFormat = "20060102T150405.000000000Z"
+
+// backups returns the paths of the rotated journals, oldest first.
+func (j *Journal) backups() ([]string, error) {
+	paths, err := filepath.Glob(j.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(j.path) + "."
+	var a []string
+	for _, path := range paths {
+		if _, err := time.Parse(journalBackupTimeFormat, strings.TrimPrefix(filepath.Base(path), prefix)); err == nil {
+			a = append(a, path)
+		}
+	}
+	sort.Strings(a)
+	return a, nil
+}
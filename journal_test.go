@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Ensure visits journaled before a live restore are not replayed afterwards
+// and new visits are numbered after the restored rows.
+func TestJournal_Reset(t *testing.T) {
+	dir := t.TempDir()
+	createTestPageViews(t, filepath.Join(dir, "db"), 5)
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	path := filepath.Join(dir, "journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if _, err := j.Reconcile(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Journal more visits than the restored database holds, across a rotation.
+	j.MaxSize = 64
+	for i := 0; i < 10; i++ {
+		if _, err := j.Append(formatTime(time.Now(), false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backups, err := j.backups(); err != nil {
+		t.Fatal(err)
+	} else if len(backups) == 0 {
+		t.Fatal("expected rotated journals")
+	}
+
+	if err := j.Reset(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if backups, err := j.backups(); err != nil {
+		t.Fatal(err)
+	} else if len(backups) != 0 {
+		t.Fatalf("rotated journals not removed: %v", backups)
+	} else if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 0 {
+		t.Fatalf("journal size=%d, want 0", fi.Size())
+	}
+
+	if id, err := j.Append(formatTime(time.Now(), false)); err != nil {
+		t.Fatal(err)
+	} else if id != 6 {
+		t.Fatalf("id=%d, want 6 after the restored rows", id)
+	}
+
+	// Only the visit journaled after the reset is replayed.
+	if n, err := j.Reconcile(context.Background(), db); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("replayed %d visits, want 1", n)
+	}
+}
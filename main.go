@@ -3,12 +3,18 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,6 +26,467 @@ import (
 // addr is the bind address for the web server.
 const addr = ":8080"
 
+// version is the application version. It is set at build time with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// DefaultWaitFirstSyncTimeout is the default time to wait for the first
+// replica sync with -wait-first-sync-before-listen.
+const DefaultWaitFirstSyncTimeout = 1 * time.Minute
+
+// DefaultRestoreSpaceMargin is the default multiple of the compressed restore
+// size required to be free before restoring. It allows for LZ4 compression
+// and the temporary files written during restore.
+const DefaultRestoreSpaceMargin = 3.0
+
+// DefaultShutdownTimeout is the default time allowed for a graceful shutdown.
+const DefaultShutdownTimeout = 10 * time.Second
+
+// DefaultMaxBodyBytes is the default request body size limit. No endpoint
+// reads a body larger than a few form values.
+const DefaultMaxBodyBytes = 64 << 10
+
+// Config represents the configuration parsed from the command line.
+type Config struct {
+	DSN    string
+	Bucket string
+
+	// Region of Bucket. If empty, it is looked up from the bucket.
+	Region string
+
+	// Additional replicas to attach alongside the primary "s3" replica for
+	// Bucket. Replicas are listed in priority order.
+	Replicas ReplicaConfigs
+
+	// Name of the replica to restore from. Defaults to the primary replica.
+	RestoreFrom string
+
+	// If true, a failed restore falls back to the other replicas in order.
+	RestoreFallback bool
+
+	// Policy used when replicas disagree on the latest generation.
+	ReplicaConflict string
+
+	// Generation & WAL index to restore to. By default the latest
+	// generation is restored in full. A negative index disables.
+	RestoreGeneration string
+	RestoreIndex      int
+
+	// If true, the oldest generation is restored instead of the latest.
+	RestoreOldest bool
+
+	// Policy used when the snapshots & WAL of the restore target do not
+	// line up, e.g. due to corrupted or partially deleted replica data.
+	RestoreInconsistent string
+
+	// If true, RestoreGeneration is restored to RestoreIndex and served
+	// read-only without replication.
+	Frozen bool
+
+	// Multiple of the estimated restore size which must be free on the
+	// volume before restoring. Zero disables the check.
+	RestoreSpaceMargin float64
+
+	// Path to a file holding the expected SHA-256 hash of a restored
+	// database. If set, startup fails when a restore does not match it.
+	ChecksumFile string
+
+	// Number of completed restores kept in the restore history file. Zero
+	// disables the history.
+	RestoreHistorySize int
+
+	// Shell command run after a successful restore. If required, startup
+	// fails when it exits non-zero.
+	PostRestoreHook         string
+	PostRestoreHookRequired bool
+
+	// Minimum number of tables an existing local database must have to be
+	// kept instead of restored. Zero keeps any existing file.
+	MinLocalTables int
+
+	// If true, running on a network filesystem only logs a warning instead
+	// of refusing to start.
+	AllowNetworkFS bool
+
+	// If true, replica buckets that do not exist are created at startup in
+	// S3CreateBucketRegion with the S3CreateBucketACL canned ACL.
+	S3CreateBucket       bool
+	S3CreateBucketRegion string
+	S3CreateBucketACL    string
+
+	// Directory that holds the database. If set, DSN must be a bare filename
+	// and is joined to this directory. The WAL & SHM files are always created
+	// by SQLite next to the database so they live here as well.
+	DataDir string
+
+	// Maximum age of the restore target's latest write. If the replica has
+	// not been updated within this window then startup is refused, unless
+	// MaxRestoreAgeWarn is set in which case only a warning is logged.
+	MaxRestoreAge     time.Duration
+	MaxRestoreAgeWarn bool
+
+	// If true, the local database is replaced by a restore even if it exists.
+	// Up to ForceRestoreBackups previous databases are kept as backups.
+	ForceRestore        bool
+	ForceRestoreBackups int
+
+	// Maximum number of instances restoring from the bucket at the same
+	// time. Coordinated through ticket objects in the bucket. Zero disables.
+	RestoreConcurrency int
+
+	// The /ready endpoint reports unhealthy until ReadyTable contains at least
+	// MinReadyRows rows or until ReadyTimeout passes, if non-zero.
+	MinReadyRows int
+	ReadyTable   string
+	ReadyTimeout time.Duration
+
+	// Minimum number of healthy replicas for /ready to report ready. A
+	// replica is unhealthy after ReplicaUnhealthyFailures consecutive failed
+	// syncs. Zero disables the check.
+	ReadyMinHealthyReplicas  int
+	ReplicaUnhealthyFailures int
+
+	// Path to a file of DDL the database schema is compared against on
+	// startup. SchemaDrift determines if a difference fails startup ("fail")
+	// or is only logged ("warn").
+	ExpectedSchema string
+	SchemaDrift    string
+
+	// Page size & auto-vacuum mode applied to a newly created database.
+	// These cannot be changed once the database exists.
+	PageSize   int
+	AutoVacuum string
+
+	// Page cache size & temporary storage mode set on every connection to
+	// the database. Zero values leave the SQLite defaults in place.
+	CacheSize int
+	TempStore string
+
+	// Determines how write transactions are begun: "immediate" takes the
+	// write lock upfront and "deferred" on the first write.
+	TxMode string
+
+	// Maximum time a pooled database connection is reused before it is
+	// replaced. Zero reuses connections indefinitely.
+	ConnMaxLifetime time.Duration
+
+	// If true, the generation is created & snapshotted to every replica
+	// during startup rather than lazily on the first write.
+	EagerBaseline bool
+
+	// Minimum time between snapshots of a generation. Snapshots triggered
+	// sooner are skipped. Zero disables.
+	MinSnapshotInterval time.Duration
+
+	// If true, the page_views table is not created on startup. The schema is
+	// expected to be managed externally, e.g. by migrations.
+	NoSchema bool
+
+	// If true, each page view records the application version that wrote it
+	// in a version column, which is added to page_views if missing.
+	RecordVersion bool
+
+	// Path to an append-only journal of visits. If set, each visit is
+	// journaled before it is inserted and unreconciled visits are replayed
+	// into the database on startup.
+	JournalFile string
+
+	// Size at which the journal is rotated, and the number & maximum age of
+	// rotated journals kept. Zero values disable rotation & pruning.
+	JournalMaxSize    int64
+	JournalMaxBackups int
+	JournalMaxAge     time.Duration
+
+	// Determines how the total page view count is read. "scan" counts the
+	// page_views table on every request while "counter" reads an aggregate
+	// row from the counters table which is maintained by triggers.
+	CountMode string
+
+	// Determines whether the count is read within the write transaction
+	// ("strict") or from an in-memory cache ("eventual").
+	CountConsistency string
+
+	// Maximum time to wait for the initial count when the count is cached.
+	// On timeout an estimate is used until the next reload. Zero disables.
+	CountSeedTimeout time.Duration
+
+	// Duration that Idempotency-Key headers are remembered to deduplicate
+	// retried writes, and the maximum number of keys held. Zero TTL disables.
+	IdempotencyTTL     time.Duration
+	IdempotencyMaxKeys int
+
+	// If true, replica sync latency observations carry the caller's trace ID
+	// as an OpenMetrics exemplar when a traceparent header is present.
+	TraceExemplars bool
+
+	// Overrides GOMAXPROCS if non-zero. Otherwise, if GOMAXPROCSCgroup is
+	// set, GOMAXPROCS is derived from the cgroup CPU quota.
+	GOMAXPROCS       int
+	GOMAXPROCSCgroup bool
+
+	// Determines how replica authentication failures, e.g. from expired
+	// credentials, are handled: "refresh" rebuilds the client to re-read
+	// credentials while "unhealthy" only reports them. Either way /healthz
+	// reports unhealthy after ReplicaAuthFailureThreshold consecutive failures.
+	ReplicaAuthPolicy           string
+	ReplicaAuthFailureThreshold int
+
+	// Time between proactive refreshes of the replica credentials, so
+	// temporary credentials are renewed before they expire. Zero disables.
+	CredentialRefreshInterval time.Duration
+
+	// Source of the replica credentials, fetched before the replica clients
+	// are built: a shell command printing them as JSON or the ID of an AWS
+	// Secrets Manager secret. If neither is set, the default AWS credential
+	// chain is used.
+	CredentialsCmd    string
+	CredentialsSecret string
+
+	// Exponential backoff applied when background replica syncs fail. The
+	// interval is reset once a sync succeeds.
+	SyncBackoffInitial    time.Duration
+	SyncBackoffMultiplier float64
+	SyncBackoffMax        time.Duration
+
+	// Window & byte threshold for coalescing database changes into a single
+	// background replica sync. A zero window disables coalescing.
+	SyncCoalesceWindow time.Duration
+	SyncCoalesceBytes  int64
+
+	// If non-zero, checkpoints are issued by the application instead of
+	// Litestream and writes wait up to CheckpointWait for them to finish.
+	CheckpointWait time.Duration
+
+	// Time between cheap checks of the database & WAL file sizes. An anomaly
+	// marks /healthz as unhealthy. Zero disables.
+	FileCheckInterval time.Duration
+
+	// Maximum size of a request body. Larger requests are rejected with 413.
+	// Zero disables the limit.
+	MaxBodyBytes int64
+
+	// If true, responses from the read & admin endpoints of at least
+	// CompressMinSize bytes are gzip encoded for clients which accept it.
+	Compress        bool
+	CompressMinSize int
+
+	// Maximum time to wait on shutdown for in-flight requests to finish and
+	// for the final sync to the replicas.
+	ShutdownTimeout time.Duration
+
+	// Time to keep serving after SIGTERM with /ready failing, so load
+	// balancers deregister the instance before it shuts down. Zero disables.
+	PreshutdownDelay time.Duration
+
+	// If true, the database is quick checked before the final sync on
+	// shutdown and is not synced if corrupt. With CheckOnShutdownSnapshot, a
+	// final snapshot is written to every replica if the check passes.
+	CheckOnShutdown         bool
+	CheckOnShutdownSnapshot bool
+
+	// Minimum time between background replica syncs and time between checks
+	// of the database position.
+	SyncInterval    time.Duration
+	MonitorInterval time.Duration
+
+	// File of flags re-read on SIGHUP. Only the sync & monitor intervals and
+	// the shutdown timeout are applied without a restart.
+	ReloadFile string
+
+	// If true, concurrent requests share a single database sync instead of
+	// each running their own.
+	SyncBatching bool
+
+	// Number of retries shared by replica syncs & restores, and the time to
+	// regain each one. Zero disables the budget.
+	RetryBudget       int
+	RetryBudgetRefill time.Duration
+
+	// Maximum number of replica syncs running at once. Zero is unbounded.
+	SyncWorkers int
+
+	// Time between audits comparing the replicated state with the local
+	// database, and how they compare. Zero interval disables.
+	AuditInterval time.Duration
+	AuditMethod   string
+
+	// Time between background verifications that each replica's latest
+	// generation restores & passes a quick check. Each restore is bounded by
+	// VerifyTimeout and verifications are postponed while more than
+	// VerifyMaxInflight writes are in progress. Zero interval disables and
+	// zero max never postpones.
+	VerifyInterval    time.Duration
+	VerifyTimeout     time.Duration
+	VerifyMaxInflight int
+
+	// If true, the web server only starts listening once every replica has
+	// synced. After WaitFirstSyncTimeout, startup either continues with a
+	// warning or fails if WaitFirstSyncFail is set. Zero timeout waits forever.
+	WaitFirstSync        bool
+	WaitFirstSyncTimeout time.Duration
+	WaitFirstSyncFail    bool
+
+	// Time between heartbeat writes which keep the replica showing recent
+	// activity without traffic. Zero disables.
+	HeartbeatInterval time.Duration
+
+	// Query run after startup, before reporting ready, to read frequently
+	// accessed pages into the OS page cache. Empty disables.
+	WarmupQuery string
+
+	// Time between replication summary log lines. Zero disables.
+	SummaryInterval time.Duration
+
+	// CloudWatch namespace replication metrics are published under, on every
+	// interval. Empty disables. The region defaults to that of -bucket.
+	CloudWatchNamespace string
+	CloudWatchInterval  time.Duration
+	CloudWatchRegion    string
+
+	// Certificate & key files for serving HTTPS. Connections must negotiate
+	// at least TLSMinVersion. TLSCipherSuites optionally restricts the TLS 1.2
+	// cipher suites to a comma-separated list of names.
+	TLSCert         string
+	TLSKey          string
+	TLSMinVersion   string
+	TLSCipherSuites string
+
+	// If true, GET requests record a page view as well as POST requests.
+	// Retains the behavior from before GET was made read-only.
+	WriteOnGet bool
+
+	// Path prefix all routes are served under, e.g. "/app", for deployments
+	// behind a shared reverse proxy. Empty serves from the root.
+	BasePath string
+
+	// If true, a read-only HTML dashboard is served at /dashboard.
+	Dashboard bool
+
+	// Maximum number of generations listed by the dashboard, if non-zero.
+	DashboardGenerationLimit int
+
+	// Authentication required by the admin & metrics endpoints: "none",
+	// "token", "basic" or "mtls". Secrets are read from files.
+	AdminAuth          string
+	AdminTokenFile     string
+	AdminBasicAuthFile string
+	AdminClientCA      string
+
+	// Path to a file admin actions are audited to as JSON lines. If empty,
+	// they are audited to the application log.
+	AdminAuditLog string
+
+	// Maximum number of concurrent /events clients.
+	EventsMaxClients int
+
+	// If true, operational endpoints under /admin/ are registered.
+	Admin bool
+
+	// Determines how reads are answered while a live restore replaces the
+	// database contents. "stale" serves the last known count and "error"
+	// returns 503. If empty, reads go to the database as usual.
+	ReadDuringRestore string
+
+	// If true, timestamps are stored & printed in the local time zone
+	// instead of UTC.
+	LocalTime bool
+
+	// Only log one in every LogSample successful requests. Requests slower
+	// than LogSlow are always logged. Errors are always logged.
+	LogSample int
+	LogSlow   time.Duration
+
+	// Hook executed when the Litestream generation changes. Either a shell
+	// command, a webhook URL, or both may be specified.
+	GenerationHookCmd      string
+	GenerationHookURL      string
+	GenerationHookDebounce time.Duration
+
+	// If true, writes are refused after a generation change that the
+	// application did not initiate, until restarted.
+	GenerationChangeHalt bool
+}
+
+// PrimaryReplicaName is the name of the replica for the -bucket flag.
+const PrimaryReplicaName = "s3"
+
+// allReplicas returns the primary replica followed by the additional replicas.
+func (c *Config) allReplicas() ReplicaConfigs {
+	return append(ReplicaConfigs{{Name: PrimaryReplicaName, Bucket: c.Bucket, Region: c.Region}}, c.Replicas...)
+}
+
+// ReplicaConfig represents the configuration for a single S3 replica.
+type ReplicaConfig struct {
+	Name   string
+	Bucket string
+	Region string // optional, looked up from the bucket if empty
+}
+
+// ReplicaConfigs is a list of replica configurations which can be set by a
+// repeated command line flag in the format "NAME=BUCKET" or
+// "NAME=BUCKET@REGION".
+type ReplicaConfigs []ReplicaConfig
+
+// String returns the flag representation of the replica configs.
+func (a *ReplicaConfigs) String() string {
+	s := make([]string, len(*a))
+	for i, rc := range *a {
+		s[i] = rc.Name + "=" + rc.Bucket
+		if rc.Region != "" {
+			s[i] += "@" + rc.Region
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses a "NAME=BUCKET[@REGION]" flag value and appends it to the list.
+// Bucket names cannot contain "@" so the region suffix is unambiguous.
+func (a *ReplicaConfigs) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 || i == len(v)-1 {
+		return fmt.Errorf("replica must be in the format NAME=BUCKET[@REGION]: %q", v)
+	}
+	rc := ReplicaConfig{Name: v[:i], Bucket: v[i+1:]}
+	if j := strings.Index(rc.Bucket, "@"); j >= 0 {
+		rc.Bucket, rc.Region = rc.Bucket[:j], rc.Bucket[j+1:]
+		if rc.Bucket == "" || rc.Region == "" {
+			return fmt.Errorf("replica must be in the format NAME=BUCKET[@REGION]: %q", v)
+		}
+	}
+	*a = append(*a, rc)
+	return nil
+}
+
+// Count modes.
+const (
+	CountModeScan    = "scan"
+	CountModeCounter = "counter"
+)
+
+// Transaction modes used to begin write transactions.
+const (
+	// Take the write lock at BEGIN so a transaction cannot fail with
+	// SQLITE_BUSY when upgrading its lock partway through.
+	TxModeImmediate = "immediate"
+
+	// Take the write lock on the first write, SQLite's default.
+	TxModeDeferred = "deferred"
+)
+
+// counterSchema creates the counters table & the triggers that keep the
+// page view counter in sync with the page_views table. The counter is seeded
+// from the existing rows the first time it is created.
+const counterSchema = `
+CREATE TABLE IF NOT EXISTS counters (name TEXT PRIMARY KEY, value INTEGER NOT NULL);
+CREATE TRIGGER IF NOT EXISTS page_views_insert_counter AFTER INSERT ON page_views BEGIN
+	UPDATE counters SET value = value + 1 WHERE name = 'page_views';
+END;
+CREATE TRIGGER IF NOT EXISTS page_views_delete_counter AFTER DELETE ON page_views BEGIN
+	UPDATE counters SET value = value - 1 WHERE name = 'page_views';
+END;
+INSERT OR IGNORE INTO counters (name, value) SELECT 'page_views', COUNT(1) FROM page_views;
+`
+
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -31,144 +498,1081 @@ func run() error {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
 	defer stop()
 
+	// Run subcommand, if specified.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			return runReplay(ctx, os.Args[2:])
+		case "migrate-replica":
+			return runMigrateReplica(ctx, os.Args[2:])
+		case "manifest":
+			return runManifest(ctx, os.Args[2:])
+		}
+	}
+
 	// Parse command line flags.
-	dsn := flag.String("dsn", "", "datasource name")
-	bucket := flag.String("bucket", "", "s3 replica bucket")
+	var config Config
+	flag.StringVar(&config.DSN, "dsn", "", "datasource name")
+	flag.StringVar(&config.Bucket, "bucket", "", "s3 replica bucket")
+	flag.StringVar(&config.Region, "region", "", "region of -bucket, looked up if empty")
+	flag.Var(&config.Replicas, "replica", "additional replica as NAME=BUCKET[@REGION], may be repeated")
+	flag.StringVar(&config.RestoreFrom, "restore-from", PrimaryReplicaName, "name of the replica to restore from")
+	flag.BoolVar(&config.RestoreFallback, "restore-fallback", false, "restore from the other replicas in order if the restore fails")
+	flag.StringVar(&config.ReplicaConflict, "replica-conflict", ReplicaConflictRestoreFrom, "policy when replicas disagree on the latest generation (restore-from, latest, highest-index, fail)")
+	flag.StringVar(&config.RestoreGeneration, "generation", "", "generation to restore, defaults to the latest")
+	flag.BoolVar(&config.Frozen, "frozen", false, "serve -generation at -restore-index read-only, without replicating")
+	flag.StringVar(&config.RestoreInconsistent, "restore-inconsistent", RestoreInconsistentFail, "policy when the restore target's snapshots & WAL do not line up (fail, fallback)")
+	flag.BoolVar(&config.RestoreOldest, "restore-oldest", false, "restore the oldest generation instead of the latest")
+	flag.IntVar(&config.RestoreIndex, "restore-index", -1, "WAL index to stop the restore at, defaults to the latest")
+	flag.Float64Var(&config.RestoreSpaceMargin, "restore-space-margin", DefaultRestoreSpaceMargin, "required free space as a multiple of the estimated restore size, 0 disables")
+	flag.StringVar(&config.ChecksumFile, "checksum-file", "", "file containing the expected SHA-256 of the restored database")
+	flag.IntVar(&config.RestoreHistorySize, "restore-history-size", DefaultRestoreHistorySize, "number of restore durations kept across restarts, 0 disables")
+	flag.StringVar(&config.PostRestoreHook, "post-restore-hook", "", "shell command to run after a successful restore")
+	flag.BoolVar(&config.PostRestoreHookRequired, "post-restore-hook-required", false, "fail startup if the post-restore hook exits non-zero")
+	flag.IntVar(&config.MinLocalTables, "min-local-tables", DefaultMinLocalTables, "restore over an existing local database with fewer tables, 0 keeps any file")
+	flag.BoolVar(&config.AllowNetworkFS, "allow-network-fs", false, "allow the database to reside on a network filesystem")
+	flag.BoolVar(&config.S3CreateBucket, "s3-create-bucket", false, "create replica buckets that do not exist")
+	flag.StringVar(&config.S3CreateBucketRegion, "s3-create-bucket-region", DefaultCreateBucketRegion, "region for buckets created by -s3-create-bucket")
+	flag.StringVar(&config.S3CreateBucketACL, "s3-create-bucket-acl", DefaultCreateBucketACL, "canned ACL for buckets created by -s3-create-bucket")
+	flag.StringVar(&config.DataDir, "data-dir", "", "directory to store database files in")
+	flag.DurationVar(&config.MaxRestoreAge, "max-restore-age", 0, "refuse to restore from a replica older than this")
+	flag.BoolVar(&config.MaxRestoreAgeWarn, "max-restore-age-warn", false, "only warn when the restore target exceeds -max-restore-age")
+	flag.BoolVar(&config.ForceRestore, "force-restore", false, "restore even if the local database exists")
+	flag.IntVar(&config.ForceRestoreBackups, "force-restore-backups", 3, "number of replaced databases to keep as backups")
+	flag.IntVar(&config.RestoreConcurrency, "restore-concurrency", 0, "max instances restoring from the bucket at once")
+	flag.IntVar(&config.MinReadyRows, "min-ready-rows", 0, "minimum rows in -ready-table before reporting ready")
+	flag.IntVar(&config.ReadyMinHealthyReplicas, "ready-min-healthy-replicas", 0, "minimum healthy replicas before reporting ready, 0 disables")
+	flag.IntVar(&config.ReplicaUnhealthyFailures, "replica-unhealthy-failures", DefaultReplicaUnhealthyFailures, "consecutive failed syncs before a replica is reported unhealthy")
+	flag.StringVar(&config.ReadyTable, "ready-table", "page_views", "table checked by -min-ready-rows")
+	flag.DurationVar(&config.ReadyTimeout, "ready-timeout", 0, "report ready after this duration even if -min-ready-rows is not met")
+	flag.StringVar(&config.ExpectedSchema, "expected-schema", "", "file of DDL to compare the database schema against on startup")
+	flag.StringVar(&config.SchemaDrift, "schema-drift", SchemaDriftFail, "action on a difference from -expected-schema (fail, warn)")
+	flag.IntVar(&config.PageSize, "page-size", 0, "page size for a new database")
+	flag.StringVar(&config.AutoVacuum, "auto-vacuum", "", "auto-vacuum mode for a new database (none, full, incremental)")
+	flag.IntVar(&config.CacheSize, "cache-size", 0, "page cache size per connection, in pages if positive or KiB if negative (0 uses the SQLite default of 2 MiB)")
+	flag.DurationVar(&config.ConnMaxLifetime, "db-conn-max-lifetime", 0, "replace pooled database connections after this duration, 0 reuses them indefinitely")
+	flag.StringVar(&config.TxMode, "tx-mode", TxModeImmediate, "how write transactions take the write lock (immediate, deferred)")
+	flag.StringVar(&config.TempStore, "temp-store", "", "storage for temporary tables & indexes (default, file, memory)")
+	flag.BoolVar(&config.EagerBaseline, "eager-baseline", false, "create & snapshot the generation at startup instead of on the first write")
+	flag.DurationVar(&config.MinSnapshotInterval, "min-snapshot-interval", 0, "minimum time between snapshots of a generation, 0 disables")
+	flag.BoolVar(&config.NoSchema, "no-schema", false, "skip creating the page_views table")
+	flag.BoolVar(&config.RecordVersion, "record-version", false, "record the app version with each page view")
+	flag.StringVar(&config.JournalFile, "journal-file", "", "append-only journal of visits")
+	flag.Int64Var(&config.JournalMaxSize, "journal-max-size", 0, "rotate the journal once it reaches this many bytes, 0 disables")
+	flag.IntVar(&config.JournalMaxBackups, "journal-max-backups", 0, "number of rotated journals to keep, 0 keeps all")
+	flag.DurationVar(&config.JournalMaxAge, "journal-max-age", 0, "delete rotated journals older than this, 0 keeps all")
+	flag.StringVar(&config.CountMode, "count-mode", CountModeScan, "page view count method (scan, counter)")
+	flag.StringVar(&config.CountConsistency, "count-consistency", CountConsistencyStrict, "page view count consistency (strict, eventual)")
+	flag.DurationVar(&config.CountSeedTimeout, "count-seed-timeout", 0, "use an estimated count if the initial cached count takes longer than this, and keep the cached count if a reload does")
+	flag.DurationVar(&config.IdempotencyTTL, "idempotency-ttl", DefaultIdempotencyTTL, "how long Idempotency-Key headers are remembered, 0 disables")
+	flag.IntVar(&config.IdempotencyMaxKeys, "idempotency-max-keys", DefaultIdempotencyMaxKeys, "maximum number of idempotency keys remembered")
+	flag.BoolVar(&config.TraceExemplars, "trace-exemplars", false, "attach trace IDs to sync latency metrics")
+	flag.IntVar(&config.GOMAXPROCS, "gomaxprocs", 0, "maximum number of CPUs used, defaults to all")
+	flag.BoolVar(&config.GOMAXPROCSCgroup, "gomaxprocs-cgroup", false, "set GOMAXPROCS from the container's cgroup CPU quota")
+	flag.StringVar(&config.ReplicaAuthPolicy, "replica-auth-policy", ReplicaAuthPolicyRefresh, "handling of replica auth failures (refresh, unhealthy)")
+	flag.DurationVar(&config.CredentialRefreshInterval, "replica-credential-refresh-interval", 0, "time between proactive replica credential refreshes, 0 disables")
+	flag.StringVar(&config.CredentialsCmd, "credentials-cmd", "", "shell command printing replica credentials as JSON")
+	flag.StringVar(&config.CredentialsSecret, "credentials-secret", "", "AWS Secrets Manager secret holding replica credentials as JSON")
+	flag.IntVar(&config.ReplicaAuthFailureThreshold, "replica-auth-failure-threshold", DefaultReplicaAuthFailureThreshold, "consecutive replica auth failures before reporting unhealthy, 0 disables")
+	flag.DurationVar(&config.SyncBackoffInitial, "sync-backoff-initial", DefaultSyncBackoffInitial, "initial retry interval after a failed replica sync")
+	flag.Float64Var(&config.SyncBackoffMultiplier, "sync-backoff-multiplier", DefaultSyncBackoffMultiplier, "retry interval multiplier after each failed replica sync")
+	flag.DurationVar(&config.SyncBackoffMax, "sync-backoff-max", DefaultSyncBackoffMax, "maximum retry interval after failed replica syncs")
+	flag.DurationVar(&config.SyncCoalesceWindow, "sync-coalesce-window", 0, "time to collect database changes before a background replica sync")
+	flag.Int64Var(&config.SyncCoalesceBytes, "sync-coalesce-bytes", 0, "sync before the coalesce window ends once this many WAL bytes are pending")
+	flag.DurationVar(&config.CheckpointWait, "checkpoint-wait", 0, "max time writes wait for a running checkpoint, 0 disables coordination")
+	flag.DurationVar(&config.FileCheckInterval, "file-check-interval", DefaultFileCheckInterval, "time between database file size checks, 0 disables")
+	flag.DurationVar(&config.AuditInterval, "audit-interval", 0, "time between replica divergence audits, 0 disables")
+	flag.StringVar(&config.AuditMethod, "audit-method", AuditMethodChecksum, "replica audit method (count, checksum)")
+	flag.DurationVar(&config.VerifyInterval, "verify-interval", 0, "time between background restore verifications of every replica, 0 disables")
+	flag.DurationVar(&config.VerifyTimeout, "verify-timeout", DefaultVerifyTimeout, "max time to restore & check one replica during verification")
+	flag.IntVar(&config.VerifyMaxInflight, "verify-max-inflight", 0, "postpone verification while more than N writes are in progress, 0 disables")
+	flag.BoolVar(&config.WaitFirstSync, "wait-first-sync-before-listen", false, "start listening only after every replica syncs once")
+	flag.DurationVar(&config.WaitFirstSyncTimeout, "wait-first-sync-timeout", DefaultWaitFirstSyncTimeout, "max time to wait for the first replica sync, 0 waits forever")
+	flag.BoolVar(&config.WaitFirstSyncFail, "wait-first-sync-fail", false, "fail startup instead of listening if the first replica sync times out")
+	flag.DurationVar(&config.HeartbeatInterval, "heartbeat-interval", 0, "time between heartbeat writes to the heartbeats table, 0 disables")
+	flag.StringVar(&config.WarmupQuery, "warmup-query", "", "query run before reporting ready to warm the page cache, e.g. SELECT COUNT(*) FROM page_views")
+	flag.IntVar(&config.SyncWorkers, "sync-workers", 0, "max replica syncs running at once, 0 is unbounded")
+	flag.BoolVar(&config.SyncBatching, "sync-batching", false, "share one database sync between concurrent requests")
+	flag.IntVar(&config.RetryBudget, "retry-budget", 0, "retries shared by replica syncs & restores, 0 is unlimited for syncs & none for restores")
+	flag.DurationVar(&config.RetryBudgetRefill, "retry-budget-refill", DefaultRetryBudgetRefill, "time to regain one retry in the retry budget")
+	flag.DurationVar(&config.SummaryInterval, "summary-interval", 0, "time between replication summary log lines, 0 disables")
+	flag.StringVar(&config.CloudWatchNamespace, "cloudwatch-namespace", "", "publish replication metrics to this CloudWatch namespace")
+	flag.DurationVar(&config.CloudWatchInterval, "cloudwatch-interval", DefaultCloudWatchInterval, "time between CloudWatch metric publishes")
+	flag.StringVar(&config.CloudWatchRegion, "cloudwatch-region", "", "region to publish CloudWatch metrics to, defaults to the region of -bucket")
+	flag.Int64Var(&config.MaxBodyBytes, "max-body-bytes", DefaultMaxBodyBytes, "max request body size in bytes, 0 for no limit")
+	flag.BoolVar(&config.Compress, "compress", false, "gzip responses from the read & admin endpoints")
+	flag.IntVar(&config.CompressMinSize, "compress-min-size", DefaultCompressMinSize, "minimum response size in bytes to gzip")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", DefaultShutdownTimeout, "max time to wait for requests & the final replica sync on shutdown")
+	flag.DurationVar(&config.PreshutdownDelay, "preshutdown-delay", 0, "time to keep serving after SIGTERM with /ready failing before shutting down")
+	flag.BoolVar(&config.CheckOnShutdown, "check-on-shutdown", false, "run PRAGMA quick_check before the final sync on shutdown & skip the sync if it fails")
+	flag.BoolVar(&config.CheckOnShutdownSnapshot, "check-on-shutdown-snapshot", false, "snapshot every replica on shutdown if -check-on-shutdown passes")
+	flag.DurationVar(&config.SyncInterval, "sync-interval", litestream.DefaultSyncInterval, "minimum time between background replica syncs")
+	flag.DurationVar(&config.MonitorInterval, "monitor-interval", litestream.DefaultMonitorInterval, "time between checks of the database position")
+	flag.StringVar(&config.ReloadFile, "reload-file", "", "file of flags to re-read on SIGHUP")
+	flag.StringVar(&config.TLSCert, "tls-cert", "", "TLS certificate file, enables HTTPS")
+	flag.StringVar(&config.TLSKey, "tls-key", "", "TLS private key file")
+	flag.StringVar(&config.TLSMinVersion, "tls-min-version", DefaultTLSMinVersion, "minimum TLS version (1.2, 1.3)")
+	flag.StringVar(&config.TLSCipherSuites, "tls-cipher-suites", "", "comma-separated list of allowed TLS 1.2 cipher suites")
+	flag.BoolVar(&config.WriteOnGet, "write-on-get", false, "record a page view on GET requests as well as POST")
+	flag.StringVar(&config.BasePath, "base-path", "", "path prefix all routes are served under, e.g. /app")
+	flag.BoolVar(&config.Dashboard, "dashboard", false, "serve an HTML dashboard at /dashboard")
+	flag.IntVar(&config.DashboardGenerationLimit, "dashboard-generation-limit", DefaultDashboardGenerationLimit, "max generations listed by the dashboard, most recently updated first, 0 for no limit")
+	flag.StringVar(&config.AdminAuth, "admin-auth", AdminAuthNone, "authentication for admin & metrics endpoints (none, token, basic, mtls)")
+	flag.StringVar(&config.AdminTokenFile, "admin-token-file", "", "file containing the bearer token for -admin-auth token")
+	flag.StringVar(&config.AdminBasicAuthFile, "admin-basic-auth-file", "", "file containing USERNAME:PASSWORD for -admin-auth basic")
+	flag.StringVar(&config.AdminClientCA, "admin-client-ca", "", "CA certificate file for client certificates with -admin-auth mtls")
+	flag.StringVar(&config.ReadDuringRestore, "read-during-restore", "", "how reads are answered during a live restore (stale, error), defaults to reading the database")
+	flag.StringVar(&config.AdminAuditLog, "admin-audit-log", "", "file to write the admin action audit log to, defaults to the application log")
+	flag.IntVar(&config.EventsMaxClients, "events-max-clients", DefaultEventsMaxClients, "maximum number of concurrent /events clients")
+	flag.BoolVar(&config.Admin, "admin", false, "enable admin endpoints")
+	flag.BoolVar(&config.LocalTime, "local-time", false, "use local time instead of UTC for timestamps")
+	flag.IntVar(&config.LogSample, "log-sample", 1, "log one in every N successful requests")
+	flag.DurationVar(&config.LogSlow, "log-slow", 0, "always log requests slower than this duration")
+	flag.StringVar(&config.GenerationHookCmd, "generation-hook-cmd", "", "shell command to run when the generation changes")
+	flag.StringVar(&config.GenerationHookURL, "generation-hook-url", "", "webhook URL to POST to when the generation changes")
+	flag.DurationVar(&config.GenerationHookDebounce, "generation-hook-debounce", DefaultGenerationHookDebounce, "time to wait for generation changes to settle")
+	flag.BoolVar(&config.GenerationChangeHalt, "generation-change-halt", false, "refuse writes after an unexpected generation change")
 	flag.Parse()
-	if *dsn == "" {
+	config.BasePath = strings.TrimRight(config.BasePath, "/")
+	if config.DSN == "" {
 		flag.Usage()
 		return fmt.Errorf("required: -dsn PATH")
-	} else if *bucket == "" {
+	} else if config.Bucket == "" {
 		flag.Usage()
 		return fmt.Errorf("required: -bucket NAME")
+	} else if config.CountMode != CountModeScan && config.CountMode != CountModeCounter {
+		flag.Usage()
+		return fmt.Errorf("invalid -count-mode: %q", config.CountMode)
+	} else if config.CountConsistency != CountConsistencyStrict && config.CountConsistency != CountConsistencyEventual {
+		flag.Usage()
+		return fmt.Errorf("invalid -count-consistency: %q", config.CountConsistency)
+	} else if config.PageSize != 0 && (config.PageSize < 512 || config.PageSize > 65536 || config.PageSize&(config.PageSize-1) != 0) {
+		flag.Usage()
+		return fmt.Errorf("invalid -page-size, must be a power of two between 512 & 65536: %d", config.PageSize)
+	} else if config.AutoVacuum != "" && config.AutoVacuum != "none" && config.AutoVacuum != "full" && config.AutoVacuum != "incremental" {
+		flag.Usage()
+		return fmt.Errorf("invalid -auto-vacuum: %q", config.AutoVacuum)
+	} else if config.SchemaDrift != SchemaDriftFail && config.SchemaDrift != SchemaDriftWarn {
+		flag.Usage()
+		return fmt.Errorf("invalid -schema-drift: %q", config.SchemaDrift)
+	} else if config.TxMode != TxModeImmediate && config.TxMode != TxModeDeferred {
+		flag.Usage()
+		return fmt.Errorf("invalid -tx-mode: %q", config.TxMode)
+	} else if config.TempStore != "" && config.TempStore != "default" && config.TempStore != "file" && config.TempStore != "memory" {
+		flag.Usage()
+		return fmt.Errorf("invalid -temp-store: %q", config.TempStore)
+	} else if config.Frozen && (config.RestoreGeneration == "" || config.RestoreIndex < 0) {
+		flag.Usage()
+		return fmt.Errorf("-frozen requires -generation & -restore-index")
+	} else if config.Frozen && config.Admin {
+		flag.Usage()
+		return fmt.Errorf("-frozen cannot be used with -admin")
+	} else if config.RestoreInconsistent != RestoreInconsistentFail && config.RestoreInconsistent != RestoreInconsistentFallback {
+		flag.Usage()
+		return fmt.Errorf("invalid -restore-inconsistent: %q", config.RestoreInconsistent)
+	} else if config.RestoreOldest && config.RestoreGeneration != "" {
+		flag.Usage()
+		return fmt.Errorf("-restore-oldest cannot be used with -generation")
+	} else if config.CheckOnShutdownSnapshot && !config.CheckOnShutdown {
+		flag.Usage()
+		return fmt.Errorf("-check-on-shutdown-snapshot requires -check-on-shutdown")
+	} else if config.BasePath != "" && !strings.HasPrefix(config.BasePath, "/") {
+		flag.Usage()
+		return fmt.Errorf("invalid -base-path, must start with /: %q", config.BasePath)
+	} else if config.SyncInterval <= 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -sync-interval, must be greater than zero: %s", config.SyncInterval)
+	} else if config.MonitorInterval <= 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -monitor-interval, must be greater than zero: %s", config.MonitorInterval)
+	} else if config.ReplicaAuthPolicy != ReplicaAuthPolicyRefresh && config.ReplicaAuthPolicy != ReplicaAuthPolicyUnhealthy {
+		flag.Usage()
+		return fmt.Errorf("invalid -replica-auth-policy: %q", config.ReplicaAuthPolicy)
+	} else if config.ReplicaConflict != ReplicaConflictRestoreFrom && config.ReplicaConflict != ReplicaConflictLatest &&
+		config.ReplicaConflict != ReplicaConflictHighestIndex && config.ReplicaConflict != ReplicaConflictFail {
+		flag.Usage()
+		return fmt.Errorf("invalid -replica-conflict: %q", config.ReplicaConflict)
+	} else if config.SyncBackoffInitial <= 0 || config.SyncBackoffMax < config.SyncBackoffInitial {
+		flag.Usage()
+		return fmt.Errorf("invalid sync backoff, -sync-backoff-initial must be positive & no greater than -sync-backoff-max")
+	} else if config.SyncBackoffMultiplier < 1 {
+		flag.Usage()
+		return fmt.Errorf("invalid -sync-backoff-multiplier, must be at least 1: %g", config.SyncBackoffMultiplier)
+	} else if config.MinLocalTables < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -min-local-tables: %d", config.MinLocalTables)
+	} else if config.RestoreHistorySize < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -restore-history-size: %d", config.RestoreHistorySize)
+	} else if config.AuditInterval < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -audit-interval: %s", config.AuditInterval)
+	} else if config.AuditMethod != AuditMethodCount && config.AuditMethod != AuditMethodChecksum {
+		flag.Usage()
+		return fmt.Errorf("invalid -audit-method: %q", config.AuditMethod)
+	} else if config.VerifyInterval < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -verify-interval: %s", config.VerifyInterval)
+	} else if config.VerifyTimeout <= 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -verify-timeout: %s", config.VerifyTimeout)
+	} else if config.VerifyMaxInflight < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -verify-max-inflight: %d", config.VerifyMaxInflight)
+	} else if config.HeartbeatInterval < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -heartbeat-interval: %s", config.HeartbeatInterval)
+	} else if config.SyncWorkers < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -sync-workers: %d", config.SyncWorkers)
+	} else if config.RetryBudget < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -retry-budget: %d", config.RetryBudget)
+	} else if config.RetryBudget > 0 && config.RetryBudgetRefill <= 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -retry-budget-refill, must be positive: %s", config.RetryBudgetRefill)
+	} else if config.JournalMaxSize < 0 || config.JournalMaxBackups < 0 || config.JournalMaxAge < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid journal rotation, -journal-max-size, -journal-max-backups & -journal-max-age must not be negative")
+	} else if config.ReadyMinHealthyReplicas < 0 || config.ReadyMinHealthyReplicas > len(config.allReplicas()) {
+		flag.Usage()
+		return fmt.Errorf("invalid -ready-min-healthy-replicas, must be between 0 & the number of replicas: %d", config.ReadyMinHealthyReplicas)
+	} else if config.ReplicaUnhealthyFailures < 1 {
+		flag.Usage()
+		return fmt.Errorf("invalid -replica-unhealthy-failures, must be at least 1: %d", config.ReplicaUnhealthyFailures)
+	} else if config.ReadDuringRestore != "" && config.ReadDuringRestore != ReadDuringRestoreStale && config.ReadDuringRestore != ReadDuringRestoreError {
+		flag.Usage()
+		return fmt.Errorf("invalid -read-during-restore: %q", config.ReadDuringRestore)
+	} else if config.PreshutdownDelay < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -preshutdown-delay: %s", config.PreshutdownDelay)
+	} else if config.MinSnapshotInterval < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -min-snapshot-interval: %s", config.MinSnapshotInterval)
+	} else if config.CompressMinSize < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -compress-min-size: %d", config.CompressMinSize)
+	} else if config.CredentialsCmd != "" && config.CredentialsSecret != "" {
+		flag.Usage()
+		return fmt.Errorf("-credentials-cmd cannot be used with -credentials-secret")
+	} else if config.CredentialRefreshInterval < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -replica-credential-refresh-interval: %s", config.CredentialRefreshInterval)
+	} else if config.SummaryInterval < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -summary-interval: %s", config.SummaryInterval)
+	} else if config.CloudWatchNamespace != "" && config.CloudWatchInterval <= 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -cloudwatch-interval, must be positive: %s", config.CloudWatchInterval)
+	} else if config.GOMAXPROCS < 0 {
+		flag.Usage()
+		return fmt.Errorf("invalid -gomaxprocs: %d", config.GOMAXPROCS)
+	} else if (config.TLSCert == "") != (config.TLSKey == "") {
+		flag.Usage()
+		return fmt.Errorf("-tls-cert & -tls-key must be specified together")
+	}
+
+	// In restore mode, e.g. as an init container, only restore the database
+	// and exit so the main container starts with a local copy. This is
+	// decided before any of the server's own setup runs.
+	switch mode := os.Getenv("LITESTREAM_MODE"); mode {
+	case "", "serve":
+	case "restore":
+		return runRestore(ctx, config)
+	default:
+		return fmt.Errorf("invalid LITESTREAM_MODE: %q", mode)
+	}
+
+	// Build TLS configuration upfront so insecure settings fail fast.
+	tlsConfig, err := newTLSConfig(config.TLSMinVersion, config.TLSCipherSuites)
+	if err != nil {
+		flag.Usage()
+		return err
+	}
+
+	// Load admin credentials upfront so misconfiguration fails fast.
+	adminAuth, err := NewAdminAuth(config)
+	if err != nil {
+		flag.Usage()
+		return err
+	} else if err := adminAuth.ConfigureTLS(tlsConfig, config.AdminClientCA); err != nil {
+		return err
+	}
+
+	// Publish the settings that can be changed by a reload.
+	settings.Init(config)
+
+	// Share a budget of retries between replica syncs & restores, if set.
+	if config.RetryBudget > 0 {
+		retryBudget = NewRetryBudget(config.RetryBudget, config.RetryBudgetRefill)
+	}
+
+	// Report replicas unhealthy after repeated sync failures.
+	replicaHealth.Threshold = config.ReplicaUnhealthyFailures
+
+	// Bound concurrent replica syncs, if set.
+	if config.SyncWorkers > 0 {
+		syncPool = NewSyncPool(config.SyncWorkers)
+	}
+
+	// Limit CPU usage before starting any background goroutines.
+	configureRuntime(config.GOMAXPROCS, config.GOMAXPROCSCgroup)
+
+	// Resolve the database path against the data directory, if specified.
+	if config.DataDir != "" {
+		path, err := dataPath(config.DataDir, config.DSN)
+		if err != nil {
+			return err
+		}
+		config.DSN = path
+	}
+
+	// Record the effective configuration before anything can fail.
+	logConfig(config)
+
+	// SQLite's locking is unreliable on network filesystems which can lead
+	// to silent corruption so refuse to run on one unless explicitly allowed.
+	if err := checkFilesystem(filepath.Dir(config.DSN), config.AllowNetworkFS); err != nil {
+		return err
+	}
+
+	// Fetch credentials from a secrets backend, if configured, before any
+	// AWS session is created.
+	if err := initCredentials(config); err != nil {
+		return err
+	}
+
+	// Create missing buckets before any replica tries to restore from them.
+	if config.S3CreateBucket {
+		for _, rc := range config.allReplicas() {
+			region := rc.Region
+			if region == "" {
+				region = config.S3CreateBucketRegion
+			}
+			if err := createBucket(ctx, rc.Bucket, region, config.S3CreateBucketACL); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Serve a fixed point read-only, without replicating, if frozen.
+	if config.Frozen {
+		return runFrozen(ctx, config, tlsConfig, adminAuth)
 	}
 
 	// Create a Litestream DB and attached replica to manage background replication.
-	lsdb, err := replicate(ctx, *dsn, *bucket)
+	lsdb, firstSync, err := replicate(ctx, config)
 	if err != nil {
 		return err
 	}
-	defer lsdb.SoftClose()
+	defer func() {
+		closeReplication(lsdb, settings.ShutdownTimeout(), config.CheckOnShutdown, config.CheckOnShutdownSnapshot, config.MinSnapshotInterval)
+	}()
 
-	// Open database file.
-	db, err := sql.Open("sqlite3", *dsn)
+	// Determine if the application is creating a new database.
+	_, err = os.Stat(config.DSN)
+	isNew := os.IsNotExist(err)
+
+	// Open database file through a driver that tunes every pooled connection,
+	// including ones opened after startup. Transactions begin with BEGIN
+	// IMMEDIATE or BEGIN DEFERRED per -tx-mode.
+	driverName := registerTunedDriver(config.CacheSize, config.TempStore)
+	db, err := sql.Open(driverName, config.DSN+"?_txlock="+config.TxMode)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
 
-	// Create table for storing page views.
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS page_views (id INTEGER PRIMARY KEY, timestamp TEXT);`); err != nil {
-		return fmt.Errorf("cannot create table: %w", err)
+	// Apply file format settings before anything else writes to a new database.
+	if err := applyStorageSettings(ctx, db, isNew, config.PageSize, config.AutoVacuum); err != nil {
+		return err
 	}
 
-	// Run web server.
-	fmt.Printf("listening on %s\n", addr)
-	go http.ListenAndServe(addr,
-		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Start a transaction.
-			tx, err := db.Begin()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			defer tx.Rollback()
+	// Create table for storing page views, unless managed externally.
+	if !config.NoSchema {
+		if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS page_views (id INTEGER PRIMARY KEY, timestamp TEXT);`); err != nil {
+			return fmt.Errorf("cannot create table: %w", err)
+		}
 
-			// Store page view.
-			if _, err := tx.ExecContext(r.Context(), `INSERT INTO page_views (timestamp) VALUES (?);`, time.Now().Format(time.RFC3339)); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+		// Add the version column to tables created without it.
+		if config.RecordVersion {
+			if err := addVersionColumn(ctx, db); err != nil {
+				return fmt.Errorf("cannot add version column: %w", err)
 			}
+		}
+	}
 
-			// Sync litestream with current state.
-			if err := lsdb.Sync(r.Context()); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	// Maintain an aggregate counter so reads do not scan the whole table.
+	if config.CountMode == CountModeCounter {
+		if err := createCounter(db); err != nil {
+			return fmt.Errorf("cannot create counter: %w", err)
+		}
+	}
 
-			// Grab current position.
-			pos, err := lsdb.Pos()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	// Catch a restored database with an unexpected schema, e.g. from the
+	// wrong generation, before serving from it.
+	if config.ExpectedSchema != "" {
+		diffs, err := checkSchema(ctx, db, config.ExpectedSchema)
+		if err != nil {
+			return err
+		}
+		for _, diff := range diffs {
+			log.Printf("schema drift: %s", diff)
+		}
+		if len(diffs) > 0 && config.SchemaDrift == SchemaDriftFail {
+			return fmt.Errorf("database schema differs from -expected-schema in %d places", len(diffs))
+		} else if len(diffs) == 0 {
+			fmt.Println("database schema matches expected schema")
+		}
+	}
 
-			// Read total page views.
-			var n int
-			if err := tx.QueryRowContext(r.Context(), `SELECT COUNT(1) FROM page_views;`).Scan(&n); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	// Create the generation & its snapshot now instead of on the first
+	// write so there is a recoverable point before any traffic.
+	if config.EagerBaseline {
+		if err := createBaseline(ctx, lsdb, config.MinSnapshotInterval); err != nil {
+			return fmt.Errorf("cannot create baseline generation: %w", err)
+		}
+	}
 
-			// Commit transaction.
-			if err := tx.Commit(); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	// Open the visit journal & replay any visits lost by a previous crash.
+	var journal *Journal
+	if config.JournalFile != "" {
+		if journal, err = OpenJournal(config.JournalFile); err != nil {
+			return fmt.Errorf("cannot open journal: %w", err)
+		}
+		defer journal.Close()
+		journal.MaxSize = config.JournalMaxSize
+		journal.MaxBackups = config.JournalMaxBackups
+		journal.MaxAge = config.JournalMaxAge
 
-			// Sync litestream with current state again.
-			if err := lsdb.Sync(r.Context()); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		n, err := journal.Reconcile(ctx, db)
+		if err != nil {
+			return fmt.Errorf("cannot reconcile journal: %w", err)
+		}
+		fmt.Printf("journal reconciled, %d visits replayed\n", n)
+	}
 
-			// Grab new transaction position.
-			newPos, err := lsdb.Pos()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	// Serve counts from memory if eventual consistency is acceptable.
+	var countCache *CountCache
+	if config.CountConsistency == CountConsistencyEventual {
+		countCache = NewCountCache(db, config.CountMode)
+		if err := countCache.Seed(ctx, config.CountSeedTimeout); err != nil {
+			return fmt.Errorf("cannot load count: %w", err)
+		}
+		go countCache.Monitor(ctx, DefaultCountCacheReloadInterval, config.CountSeedTimeout)
+	}
 
-			// Sync litestream with S3.
-			startTime := time.Now()
-			if err := lsdb.Replicas[0].Sync(r.Context()); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			log.Printf("new transaction: pre=%s post=%s elapsed=%s", pos.String(), newPos.String(), time.Since(startTime))
+	// Notify external systems when the generation changes, if configured.
+	var notifier *GenerationNotifier
+	if config.GenerationHookCmd != "" || config.GenerationHookURL != "" {
+		notifier = NewGenerationNotifier()
+		notifier.Command = config.GenerationHookCmd
+		notifier.URL = config.GenerationHookURL
+		notifier.Debounce = config.GenerationHookDebounce
+		go notifier.Monitor(ctx, lsdb, settings.MonitorInterval)
+	}
+
+	// Detect generation changes the application did not initiate.
+	guard := NewGenerationGuard()
+	guard.Halt = config.GenerationChangeHalt
+	go guard.Monitor(ctx, lsdb, settings.MonitorInterval)
+
+	// Run web server.
+	replicationEvents.MaxClients = config.EventsMaxClients
+	s := NewServer(config, db, lsdb)
+	s.AdminAuth = adminAuth
+	s.Journal = journal
+
+	// Audit admin actions to a separate file, if set.
+	if config.Admin && config.AdminAuditLog != "" {
+		auditLog, err := OpenAdminAuditLog(config.AdminAuditLog)
+		if err != nil {
+			return fmt.Errorf("cannot open admin audit log: %w", err)
+		}
+		defer auditLog.Close()
+		s.AdminAuditLog = auditLog
+	}
+	s.CountCache = countCache
+	s.GenerationNotifier = notifier
+	s.GenerationGuard = guard
+	if config.SyncBatching {
+		s.SyncGroup = NewSyncGroup()
+	}
+
+	// Open a separate read-only connection for ad-hoc admin queries.
+	if config.Admin {
+		readDB, err := sql.Open(driverName, "file:"+config.DSN+"?mode=ro&_query_only=true")
+		if err != nil {
+			return err
+		}
+		defer readDB.Close()
+		readDB.SetConnMaxLifetime(config.ConnMaxLifetime)
+		s.ReadDB = readDB
+	}
+
+	// Issue checkpoints from the application so writes can yield to them.
+	if config.CheckpointWait > 0 {
+		s.CheckpointGate = NewCheckpointGate(config.CheckpointWait)
+		go s.CheckpointGate.Monitor(ctx, lsdb, settings.MonitorInterval)
+	}
 
-			// Print total page views.
-			fmt.Fprintf(w, "This server has been visited %d times.\n", n)
-		}),
-	)
+	// Deduplicate retried writes by idempotency key, if enabled.
+	if config.IdempotencyTTL > 0 {
+		s.Idempotency = NewIdempotencyCache()
+		s.Idempotency.TTL = config.IdempotencyTTL
+		s.Idempotency.MaxKeys = config.IdempotencyMaxKeys
+	}
+
+	// Check the database files for truncation & corruption in the background.
+	if config.FileCheckInterval > 0 {
+		go monitorFiles(ctx, s, config.DSN, config.FileCheckInterval)
+	}
+
+	// Audit the replica for divergence from the local database.
+	if config.AuditInterval > 0 {
+		go s.monitorAudit(ctx, config.AuditInterval, config.AuditMethod)
+	}
+
+	// Prove the replicas are restorable in the background, if enabled.
+	if config.VerifyInterval > 0 {
+		go s.monitorVerify(ctx, config.VerifyInterval)
+	}
+
+	// Write heartbeats so the replica shows activity without traffic.
+	if config.HeartbeatInterval > 0 {
+		go s.monitorHeartbeat(ctx, config.HeartbeatInterval)
+	}
+
+	// Log a periodic summary of replication activity, if enabled.
+	if config.SummaryInterval > 0 {
+		go logSummary(ctx, lsdb, config.SummaryInterval)
+	}
+
+	// Push replication metrics to CloudWatch, if configured.
+	if config.CloudWatchNamespace != "" {
+		publisher, err := NewCloudWatchPublisher(ctx, lsdb, config.CloudWatchNamespace, config.CloudWatchRegion)
+		if err != nil {
+			return err
+		}
+		go publisher.Monitor(ctx, config.CloudWatchInterval)
+	}
+
+	// Warm the page cache, if requested, and then report ready once the
+	// restored database has enough data, if required.
+	go func() {
+		if config.WarmupQuery != "" {
+			warmup(ctx, db, config.WarmupQuery)
+		}
+		if config.MinReadyRows > 0 {
+			waitReady(ctx, s, db, config.ReadyTable, config.MinReadyRows, config.ReadyTimeout)
+		} else {
+			s.SetReady(true)
+		}
+	}()
+	// Only accept traffic once replication is known to work, if required.
+	if config.WaitFirstSync {
+		if err := waitFirstSync(ctx, firstSync, config.WaitFirstSyncTimeout, config.WaitFirstSyncFail); ctx.Err() != nil {
+			return nil // shutting down
+		} else if err != nil {
+			return err
+		}
+	}
+
+	httpServer := &http.Server{Addr: addr, Handler: s, TLSConfig: tlsConfig}
+	if config.TLSCert != "" {
+		fmt.Printf("listening on %s (https)\n", addr)
+		go httpServer.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+	} else {
+		fmt.Printf("listening on %s\n", addr)
+		go httpServer.ListenAndServe()
+	}
+
+	// Apply changed settings from the reload file on SIGHUP, if set.
+	if config.ReloadFile != "" {
+		go reloadOnSignal(ctx, config.ReloadFile)
+	}
 
 	// Wait for signal.
 	<-ctx.Done()
 	log.Print("myapp received signal, shutting down")
 
+	// Keep serving until load balancers have seen /ready fail, if set.
+	if config.PreshutdownDelay > 0 {
+		preshutdown(s, config.PreshutdownDelay)
+	}
+
+	// Stop accepting requests & wait for in-flight writes so that the final
+	// sync includes them.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), settings.ShutdownTimeout())
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("cannot shut down http server: %s", err)
+	}
+
+	// Shutdown gives up on slow requests once the timeout passes. Don't
+	// close the database underneath a write that is about to commit.
+	if err := s.Drain(shutdownCtx); err != nil {
+		log.Printf("in-flight writes did not finish within %s, closing anyway", settings.ShutdownTimeout())
+	}
+
 	return nil
 }
 
-func replicate(ctx context.Context, dsn, bucket string) (*litestream.DB, error) {
-	// Create Litestream DB reference for managing replication.
-	lsdb := litestream.NewDB(dsn)
+// preshutdown reports s as not ready and keeps serving requests for delay,
+// so load balancers stop routing to the instance before it stops accepting
+// connections.
+func preshutdown(s *Server, delay time.Duration) {
+	s.SetReady(false)
+	log.Printf("reporting not ready, waiting before shutdown: delay=%s", delay)
+	time.Sleep(delay)
+}
 
-	// Build S3 replica and attach to database.
-	client := lss3.NewReplicaClient()
-	client.Bucket = bucket
+// reloadOnSignal reloads settings from path on every SIGHUP until ctx is done.
+func reloadOnSignal(ctx context.Context, path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
 
-	replica := litestream.NewReplica(lsdb, "s3")
-	replica.Client = client
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+		}
 
-	lsdb.Replicas = append(lsdb.Replicas, replica)
+		log.Printf("reloading settings: path=%s", path)
+		if err := settings.Reload(path); err != nil {
+			log.Printf("cannot reload settings, keeping current settings: %s", err)
+		}
+	}
+}
+
+// formatTime returns t as an RFC 3339 string in UTC, or in the local time zone
+// if local is true. Using UTC everywhere keeps stored timestamps comparable
+// across hosts in different time zones and across DST changes.
+func formatTime(t time.Time, local bool) string {
+	if local {
+		return t.Local().Format(time.RFC3339)
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// createCounter creates & seeds the page view counter within a transaction.
+func createCounter(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(counterSchema); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addVersionColumn adds the version column to page_views if it is missing.
+// Existing rows are left with a NULL version.
+func addVersionColumn(ctx context.Context, db *sql.DB) error {
+	var n int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(1) FROM pragma_table_info('page_views') WHERE name = 'version';`).Scan(&n); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	if _, err := db.ExecContext(ctx, `ALTER TABLE page_views ADD COLUMN version TEXT;`); err != nil {
+		return err
+	}
+	fmt.Println("added version column to page_views")
+	return nil
+}
+
+// isNoSuchTable returns true if err is a SQLite error for a missing table.
+func isNoSuchTable(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no such table")
+}
+
+// dataPath joins the database filename to the data directory and ensures the
+// directory exists. The restore and the application both use the returned
+// path so the database, its WAL & SHM files, and the Litestream metadata
+// directory all end up on the same volume.
+func dataPath(dir, filename string) (string, error) {
+	if filename != filepath.Base(filename) {
+		return "", fmt.Errorf("-dsn must be a filename when -data-dir is set: %q", filename)
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("cannot create data directory: %w", err)
+	}
+	return filepath.Join(dir, filename), nil
+}
+
+// createBaseline syncs lsdb so that its generation is created and then
+// snapshots the generation to each replica that does not have a snapshot yet.
+func createBaseline(ctx context.Context, lsdb *litestream.DB, minSnapshotInterval time.Duration) error {
+	if err := lsdb.Sync(ctx); err != nil {
+		return err
+	}
+
+	generation, err := lsdb.CurrentGeneration()
+	if err != nil {
+		return err
+	} else if generation == "" {
+		log.Printf("warning: no generation to snapshot, database has no wal yet")
+		return nil
+	}
+
+	for _, r := range lsdb.Replicas {
+		itr, err := r.Client.Snapshots(ctx, generation)
+		if err != nil {
+			return err
+		}
+		snapshots, err := litestream.SliceSnapshotIterator(itr)
+		if err != nil {
+			return err
+		} else if len(snapshots) > 0 {
+			continue
+		}
+
+		info, err := snapshotReplica(ctx, r, minSnapshotInterval, "baseline")
+		if errors.Is(err, ErrSnapshotCooldown) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("cannot snapshot replica %q: %w", r.Name(), err)
+		}
+		log.Printf("baseline generation created: replica=%s generation=%s index=%08x", r.Name(), generation, info.Index)
+	}
+
+	// Upload the WAL written since each snapshot to all replicas at once.
+	for _, result := range syncPool.SyncAll(ctx, lsdb.Replicas) {
+		if result.Err != nil {
+			return fmt.Errorf("cannot sync replica %q: %w", result.Replica.Name(), result.Err)
+		}
+	}
+	return nil
+}
+
+// checkFilesystem logs the filesystem type of dir and returns an error if it
+// is a network filesystem, unless allowed.
+func checkFilesystem(dir string, allow bool) error {
+	name, network, err := filesystemType(dir)
+	if err != nil {
+		log.Printf("cannot determine filesystem type: %s", err)
+		return nil
+	}
+	fmt.Printf("database filesystem: %s\n", name)
+
+	if !network {
+		return nil
+	} else if !allow {
+		return fmt.Errorf("database directory is on a network filesystem (%s) which can corrupt SQLite databases, use -allow-network-fs to override", name)
+	}
+	log.Printf("warning: database directory is on a network filesystem (%s), SQLite locking may be unreliable", name)
+	return nil
+}
+
+// waitFirstSync blocks until firstSync is closed. If timeout passes first then
+// an error is returned if fail is true, otherwise a warning is logged.
+func waitFirstSync(ctx context.Context, firstSync <-chan struct{}, timeout time.Duration, fail bool) error {
+	fmt.Println("waiting for the first replica sync before listening")
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-firstSync:
+		fmt.Println("first replica sync complete")
+		return nil
+	case <-deadline:
+		if fail {
+			return fmt.Errorf("replicas did not sync within %s", timeout)
+		}
+		log.Printf("warning: replicas did not sync within %s, listening anyway", timeout)
+		return nil
+	}
+}
+
+// replicate restores & opens the database and starts replicating it in the
+// background. The returned channel is closed once every replica has synced
+// successfully at least once.
+func replicate(ctx context.Context, config Config) (*litestream.DB, <-chan struct{}, error) {
+	lsdb, err := newDB(ctx, config)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if err := restore(ctx, replica); err != nil {
-		return nil, err
+	// Restore from the requested replica.
+	if err := restoreDB(ctx, lsdb, config); err != nil {
+		return nil, nil, err
 	}
 
 	// Initialize database.
 	if err := lsdb.Open(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	// Replicate in the background, retrying failed syncs with backoff.
+	// Track when every replica has synced once so startup can wait on it.
+	var wg sync.WaitGroup
+	for _, r := range lsdb.Replicas {
+		var once sync.Once
+		wg.Add(1)
+		go monitorReplica(ctx, r, Backoff{
+			Initial:    config.SyncBackoffInitial,
+			Multiplier: config.SyncBackoffMultiplier,
+			Max:        config.SyncBackoffMax,
+		}, Coalesce{
+			Window: config.SyncCoalesceWindow,
+			Bytes:  config.SyncCoalesceBytes,
+		}, func() { once.Do(wg.Done) })
+
+		// Renew temporary credentials before they expire, if configured.
+		if config.CredentialRefreshInterval > 0 {
+			go refreshCredentials(ctx, r.Client.(*AuthClient), config.CredentialRefreshInterval, Backoff{
+				Initial:    config.SyncBackoffInitial,
+				Multiplier: config.SyncBackoffMultiplier,
+				Max:        config.SyncBackoffMax,
+			})
+		}
+	}
+
+	firstSync := make(chan struct{})
+	go func() { wg.Wait(); close(firstSync) }()
+
+	return lsdb, firstSync, nil
+}
+
+// newDB returns a Litestream DB reference with all replicas attached. The
+// database is not opened. Replica clients use awsCredentials, if set, through
+// the environment.
+func newDB(ctx context.Context, config Config) (*litestream.DB, error) {
+	// Create Litestream DB reference for managing replication. Litestream
+	// reads the monitor interval once so later reloads do not affect it.
+	lsdb := litestream.NewDB(config.DSN)
+	lsdb.MonitorInterval = config.MonitorInterval
+
+	// Disable automatic checkpoints when the application coordinates them.
+	if config.CheckpointWait > 0 {
+		lsdb.MinCheckpointPageN = math.MaxInt32
+		lsdb.MaxCheckpointPageN = 0
+		lsdb.CheckpointInterval = 0
+	}
+
+	// Build S3 replicas and attach to database. The primary replica is first.
+	for _, rc := range config.allReplicas() {
+		if lsdb.Replica(rc.Name) != nil {
+			return nil, fmt.Errorf("duplicate replica name: %q", rc.Name)
+		}
+
+		client := lss3.NewReplicaClient()
+		client.Bucket = rc.Bucket
+		client.Region = rc.Region
+
+		// Resolve the bucket region once, as the client is replaced each
+		// time provider credentials are renewed.
+		if awsCredentials != nil {
+			region, err := replicaRegion(ctx, client)
+			if err != nil {
+				return nil, fmt.Errorf("cannot initialize replica %q: %w", rc.Name, err)
+			}
+			client.Region = region
+		}
+
+		replica := litestream.NewReplica(lsdb, rc.Name)
+		replica.Client = NewAuthClient(client, awsCredentials, rc.Name, config.ReplicaAuthPolicy, config.ReplicaAuthFailureThreshold)
+
+		// Background syncs are run by monitorReplica instead of Litestream.
+		replica.MonitorEnabled = false
+
+		lsdb.Replicas = append(lsdb.Replicas, replica)
+	}
 	return lsdb, nil
 }
 
-func restore(ctx context.Context, replica *litestream.Replica) (err error) {
-	// Skip restore if local database already exists.
-	if _, err := os.Stat(replica.DB().Path()); err == nil {
-		fmt.Println("local database already exists, skipping restore")
+// runRestore restores the database and returns without starting the server.
+// Only the setup the restore depends on is performed: the data directory,
+// replica credentials & the retry budget.
+func runRestore(ctx context.Context, config Config) error {
+	// Resolve the database path against the data directory, if specified.
+	if config.DataDir != "" {
+		path, err := dataPath(config.DataDir, config.DSN)
+		if err != nil {
+			return err
+		}
+		config.DSN = path
+	}
+
+	// Record the effective configuration before anything can fail.
+	logConfig(config)
+
+	// Share a budget of retries between restore attempts, if set.
+	if config.RetryBudget > 0 {
+		retryBudget = NewRetryBudget(config.RetryBudget, config.RetryBudgetRefill)
+	}
+
+	// Fetch credentials from a secrets backend, if configured, before any
+	// AWS session is created.
+	if err := initCredentials(config); err != nil {
+		return err
+	}
+
+	lsdb, err := newDB(ctx, config)
+	if err != nil {
+		return err
+	}
+	return restoreDB(ctx, lsdb, config)
+}
+
+// restoreDB restores lsdb from the replica selected by -restore-from. If
+// there are multiple replicas and they disagree on the latest generation, the
+// replica is chosen by -replica-conflict instead. With -restore-fallback, the
+// remaining replicas are tried in order if that restore fails.
+func restoreDB(ctx context.Context, lsdb *litestream.DB, config Config) error {
+	replica := lsdb.Replica(config.RestoreFrom)
+	if replica == nil {
+		return fmt.Errorf("replica not found for -restore-from: %q", config.RestoreFrom)
+	}
+
+	// An explicit or oldest generation is restored from -restore-from as
+	// given. The comparison is also skipped when the local database is kept
+	// anyway.
+	if len(lsdb.Replicas) > 1 && config.RestoreGeneration == "" && !config.RestoreOldest {
+		if ok, err := hasLocalDB(lsdb.Path(), config.MinLocalTables); err != nil {
+			return fmt.Errorf("cannot check local database: %w", err)
+		} else if !ok || config.ForceRestore {
+			if replica, err = selectRestoreReplica(ctx, lsdb, replica, config.ReplicaConflict, config.LocalTime); err != nil {
+				return err
+			}
+		}
+	}
+
+	err := restore(ctx, replica, config)
+	if err == nil || !config.RestoreFallback || ctx.Err() != nil {
+		return err
+	}
+
+	// Fall back to the other replicas in priority order, e.g. a bucket in
+	// another region while the preferred region is unavailable.
+	for _, r := range lsdb.Replicas {
+		if r == replica {
+			continue
+		}
+		log.Printf("restore failed, falling back: replica=%s fallback=%s err=%s", replica.Name(), r.Name(), err)
+		if err = restore(ctx, r, config); err == nil || ctx.Err() != nil {
+			return err
+		}
+		replica = r
+	}
+	return err
+}
+
+// checkRestoreSpace returns an error if the volume holding the database does
+// not have margin times the estimated restore size available. If the space
+// cannot be determined then a warning is logged and the restore proceeds.
+func checkRestoreSpace(ctx context.Context, replica *litestream.Replica, opt litestream.RestoreOptions, margin float64) error {
+	size, err := estimateRestoreSize(ctx, replica, opt)
+	if err != nil {
+		return fmt.Errorf("cannot estimate restore size: %w", err)
+	}
+
+	avail, err := availableSpace(filepath.Dir(opt.OutputPath))
+	if err != nil {
+		log.Printf("warning: cannot determine free space, skipping check: %s", err)
 		return nil
+	}
+
+	if need := int64(float64(size) * margin); avail < need {
+		return fmt.Errorf("insufficient free space to restore: available=%d required=%d (estimated size %d x margin %g)", avail, need, size, margin)
+	}
+	return nil
+}
+
+// closeReplication flushes outstanding writes to every replica and then soft
+// closes lsdb. Background replication only syncs on an interval so without a
+// final flush the last few writes may not be replicated. The flush is bounded
+// by timeout so an unreachable replica cannot block shutdown indefinitely.
+//
+// If check is true, the database is integrity checked first. A corrupt
+// database is not flushed or closed so it does not become the last state the
+// replicas receive. If snapshot is also true, a final snapshot is written to
+// every replica once the check passes, unless the replica was snapshotted
+// within minSnapshotInterval.
+func closeReplication(lsdb *litestream.DB, timeout time.Duration, check, snapshot bool, minSnapshotInterval time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if check {
+		startTime := time.Now()
+		if err := quickCheck(ctx, lsdb.Path()); err != nil {
+			log.Printf("database check failed on shutdown, skipping final sync: elapsed=%s err=%s", time.Since(startTime).Round(time.Millisecond), err)
+			return
+		}
+		log.Printf("database check passed on shutdown: elapsed=%s", time.Since(startTime).Round(time.Millisecond))
+	}
+
+	// Copy the WAL to the shadow WAL and then the shadow WAL to each replica.
+	if err := lsdb.Sync(ctx); err != nil {
+		log.Printf("cannot sync database on shutdown: %s", err)
+	}
+	for _, result := range syncPool.SyncAll(ctx, lsdb.Replicas) {
+		if result.Err != nil {
+			log.Printf("cannot sync replica on shutdown: replica=%s elapsed=%s err=%s", result.Replica.Name(), result.Elapsed, result.Err)
+		} else {
+			log.Printf("replica synced on shutdown: replica=%s elapsed=%s", result.Replica.Name(), result.Elapsed)
+		}
+	}
+
+	// Give restores a verified starting point instead of replaying the WAL.
+	if check && snapshot {
+		for _, r := range lsdb.Replicas {
+			if info, err := snapshotReplica(ctx, r, minSnapshotInterval, "shutdown"); errors.Is(err, ErrSnapshotCooldown) {
+				continue
+			} else if err != nil {
+				log.Printf("cannot snapshot replica on shutdown: replica=%s err=%s", r.Name(), err)
+			} else {
+				log.Printf("replica snapshot on shutdown: replica=%s generation=%s index=%08x", r.Name(), info.Generation, info.Index)
+			}
+		}
+	}
+
+	// SoftClose performs its own sync without a deadline so stop waiting on
+	// it once the timeout has passed.
+	ch := make(chan error, 1)
+	go func() { ch <- lsdb.SoftClose() }()
+	select {
+	case err := <-ch:
+		if err != nil {
+			log.Printf("cannot close litestream: %s", err)
+		}
+	case <-ctx.Done():
+		log.Printf("litestream did not close within %s, exiting", timeout)
+	}
+
+	for _, r := range lsdb.Replicas {
+		log.Printf("final replicated position: replica=%s pos=%s", r.Name(), r.Pos())
+	}
+}
+
+func restore(ctx context.Context, replica *litestream.Replica, config Config) (err error) {
+	// Skip restore if local database already exists, unless forced. An
+	// empty or invalid database is restored over as it holds nothing useful.
+	var exists bool
+	if _, err := os.Stat(replica.DB().Path()); err == nil {
+		if usable, err := localDBUsable(replica.DB().Path(), config.MinLocalTables); err != nil {
+			return fmt.Errorf("cannot check local database: %w", err)
+		} else if !usable {
+			fmt.Println("local database is empty or invalid, restoring over it")
+		} else if !config.ForceRestore {
+			fmt.Println("local database already exists, skipping restore")
+			return nil
+		}
+		exists = true
 	} else if !os.IsNotExist(err) {
 		return err
 	}
@@ -176,24 +1580,212 @@ func restore(ctx context.Context, replica *litestream.Replica) (err error) {
 	// Configure restore to write out to DSN path.
 	opt := litestream.NewRestoreOptions()
 	opt.OutputPath = replica.DB().Path()
-	opt.Logger = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
 
-	// Determine the latest generation to restore from.
-	if opt.Generation, _, err = replica.CalcRestoreTarget(ctx, opt); err != nil {
+	// Determine the latest generation to restore from, unless one is given
+	// or the oldest is requested.
+	var updatedAt time.Time
+	opt.Generation = config.RestoreGeneration
+	if config.RestoreOldest {
+		if opt.Generation, updatedAt, err = oldestGeneration(ctx, replica); err != nil {
+			return err
+		} else if opt.Generation == "" {
+			return fmt.Errorf("-restore-oldest: no generation found on replica %q", replica.Name())
+		}
+		log.Printf("restoring oldest generation: replica=%s generation=%s", replica.Name(), opt.Generation)
+	} else if opt.Generation, updatedAt, err = replica.CalcRestoreTarget(ctx, opt); err != nil {
 		return err
+	} else if opt.Generation == "" && config.RestoreGeneration != "" {
+		return fmt.Errorf("generation not found on replica %q: %s", replica.Name(), config.RestoreGeneration)
 	}
 
 	// Only restore if there is a generation available on the replica.
 	// Otherwise we'll let the application create a new database.
 	if opt.Generation == "" {
+		if exists {
+			fmt.Println("no generation found, keeping local database")
+			return nil
+		}
 		fmt.Println("no generation found, creating new database")
 		return nil
 	}
 
-	fmt.Printf("restoring replica for generation %s\n", opt.Generation)
-	if err := replica.Restore(ctx, opt); err != nil {
-		return err
+	// Check the snapshots & WAL line up before starting, so a corrupt replica
+	// is reported as such instead of failing partway. Unless a generation or
+	// index was requested, an earlier consistent generation may be used.
+	index := math.MaxInt32
+	if config.RestoreIndex >= 0 {
+		index = config.RestoreIndex
+	}
+	if cerr := checkRestoreConsistency(ctx, replica, opt.Generation, index); cerr != nil {
+		pinned := config.RestoreGeneration != "" || config.RestoreOldest || config.RestoreIndex >= 0
+		if config.RestoreInconsistent != RestoreInconsistentFallback || pinned {
+			return fmt.Errorf("cannot restore replica %q: %w", replica.Name(), cerr)
+		}
+
+		prev := opt.Generation
+		if opt.Generation, updatedAt, err = consistentGeneration(ctx, replica, prev); err != nil {
+			return err
+		} else if opt.Generation == "" {
+			return fmt.Errorf("cannot restore replica %q, no consistent generation: %w", replica.Name(), cerr)
+		}
+		log.Printf("restore target inconsistent, falling back: replica=%s prev=%s generation=%s err=%s", replica.Name(), prev, opt.Generation, cerr)
+	}
+
+	// Ensure the replica has been updated recently. A stale target usually
+	// means replication was broken long before this restore was needed.
+	age := time.Since(updatedAt)
+	fmt.Printf("restore target last updated %s ago (%s)\n", age.Round(time.Second), formatTime(updatedAt, config.LocalTime))
+	if config.MaxRestoreAge > 0 && age > config.MaxRestoreAge {
+		if !config.MaxRestoreAgeWarn {
+			return fmt.Errorf("restore target is too old: age=%s max=%s", age.Round(time.Second), config.MaxRestoreAge)
+		}
+		log.Printf("warning: restore target exceeds max restore age: age=%s max=%s", age.Round(time.Second), config.MaxRestoreAge)
+	}
+
+	// Stop at a specific index, if requested. Litestream does not verify the
+	// index exists so check it upfront.
+	if config.RestoreIndex >= 0 {
+		if err := validateRestoreIndex(ctx, replica, opt.Generation, config.RestoreIndex); err != nil {
+			return fmt.Errorf("invalid -restore-index: %w", err)
+		}
+		opt.Index = config.RestoreIndex
+	}
+
+	// Ensure there is room for the restore before starting it.
+	if config.RestoreSpaceMargin > 0 {
+		if err := checkRestoreSpace(ctx, replica, opt, config.RestoreSpaceMargin); err != nil {
+			return err
+		}
+	}
+
+	// Wait for our turn if concurrent restores are limited across instances.
+	if config.RestoreConcurrency > 0 {
+		sem := NewRestoreSemaphore(replica.Client.(*AuthClient).Unwrap().Bucket, config.RestoreConcurrency)
+		if err := sem.Acquire(ctx); err != nil {
+			return fmt.Errorf("cannot acquire restore semaphore: %w", err)
+		}
+		defer func() {
+			if err := sem.Release(context.Background()); err != nil {
+				log.Printf("cannot release restore semaphore: %s", err)
+			}
+		}()
+	}
+
+	// Move the existing database out of the way for a forced restore.
+	if exists {
+		if err := removeForRestore(replica.DB(), config.ForceRestoreBackups); err != nil {
+			return fmt.Errorf("cannot remove local database: %w", err)
+		}
+	}
+
+	if config.RestoreIndex >= 0 {
+		fmt.Printf("restoring replica %q for generation %s to index %08x\n", replica.Name(), opt.Generation, opt.Index)
+	} else {
+		fmt.Printf("restoring replica %q for generation %s\n", replica.Name(), opt.Generation)
+	}
+
+	// Track progress by parsing the restore log output. On a terminal, a
+	// progress bar replaces Litestream's per-WAL log lines.
+	tty := isTerminal(os.Stdout) && isTerminal(os.Stderr)
+	var logw io.Writer = os.Stderr
+	if tty {
+		logw = io.Discard
+	}
+	progress, err := NewRestoreProgress(ctx, replica, opt, logw)
+	if err != nil {
+		return fmt.Errorf("cannot determine restore range: %w", err)
+	}
+	opt.Logger = log.New(progress, "", log.LstdFlags|log.Lmicroseconds)
+
+	// Retry a failed restore with backoff, but only within a configured
+	// retry budget. Restores are not retried without one.
+	backoff := Backoff{Initial: config.SyncBackoffInitial, Multiplier: config.SyncBackoffMultiplier, Max: config.SyncBackoffMax}
+	startTime := time.Now()
+	for retargetN := 0; ; {
+		err := restoreWithProgress(ctx, replica, opt, progress, tty)
+		if err == nil {
+			break
+		} else if ctx.Err() != nil {
+			return err
+		}
+		if err := os.Remove(opt.OutputPath + ".tmp"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		// Retention may delete the generation while it is being restored.
+		// Restart from the new latest generation, unless a generation or
+		// index within it was requested.
+		if retargetN < MaxRestoreRetargets && config.RestoreGeneration == "" && !config.RestoreOldest && config.RestoreIndex < 0 {
+			if deleted, e := generationDeleted(ctx, replica, opt.Generation); e != nil {
+				log.Printf("cannot check restore target generation: %s", e)
+			} else if deleted {
+				retargetN++
+				prev := opt.Generation
+				if opt.Generation, err = retargetRestore(ctx, replica, opt); err != nil {
+					return err
+				}
+				log.Printf("restore target generation deleted, retargeting: prev=%s generation=%s attempt=%d", prev, opt.Generation, retargetN)
+				if progress, err = NewRestoreProgress(ctx, replica, opt, logw); err != nil {
+					return fmt.Errorf("cannot determine restore range: %w", err)
+				}
+				opt.Logger = log.New(progress, "", log.LstdFlags|log.Lmicroseconds)
+				continue
+			}
+		}
+
+		if retryBudget == nil || !retryBudget.Allow() {
+			return err
+		}
+		wait := backoff.Next()
+		log.Printf("restore failed, retrying: backoff=%s err=%s", wait, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
 	}
 	fmt.Println("restore complete")
+
+	// Record the restore so cold-start restore times can be tracked across
+	// restarts. Failing to record it does not fail the restore.
+	if config.RestoreHistorySize > 0 {
+		rec := RestoreRecord{Time: startTime.UTC(), Generation: opt.Generation, Seconds: time.Since(startTime).Seconds()}
+		if fi, err := os.Stat(opt.OutputPath); err == nil {
+			rec.Bytes = fi.Size()
+		}
+		if records, err := appendRestoreHistory(restoreHistoryPath(opt.OutputPath), rec, config.RestoreHistorySize); err != nil {
+			log.Printf("cannot record restore history: %s", err)
+		} else {
+			log.Printf("restore history: elapsed=%s %s", time.Since(startTime).Round(time.Millisecond), summarizeRestoreHistory(records))
+		}
+	}
+
+	// Verify the restored database against an out-of-band checksum. The
+	// database is removed on mismatch so it is not used on the next start.
+	if config.ChecksumFile != "" {
+		if err := verifyChecksum(opt.OutputPath, config.ChecksumFile); err != nil {
+			if e := os.Remove(opt.OutputPath); e != nil {
+				log.Printf("cannot remove restored database: %s", e)
+			}
+			return fmt.Errorf("cannot verify restored database: %w", err)
+		}
+		fmt.Println("restored database checksum verified")
+	}
+
+	// Let operators hook into the restore before the database is opened. If
+	// the hook is required, the database is removed on failure so the
+	// restore & hook are run again on the next start.
+	if config.PostRestoreHook != "" {
+		if err := runPostRestoreHook(ctx, config.PostRestoreHook, opt.Generation, opt.OutputPath); err != nil {
+			if config.PostRestoreHookRequired {
+				if e := os.Remove(opt.OutputPath); e != nil {
+					log.Printf("cannot remove restored database: %s", e)
+				}
+				return fmt.Errorf("post-restore hook failed: %w", err)
+			}
+			log.Printf("post-restore hook failed: %s", err)
+		}
+	}
 	return nil
 }
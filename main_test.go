@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatTime(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %s", err)
+	}
+
+	// formatTime converts with time.Local so point it at a zone with DST.
+	prev := time.Local
+	time.Local = loc
+	defer func() { time.Local = prev }()
+
+	for _, tt := range []struct {
+		name  string
+		t     time.Time
+		utc   string
+		local string
+	}{
+		// Clocks go from 02:00 EST to 03:00 EDT on 2021-03-14.
+		{"BeforeSpringForward", time.Date(2021, 3, 14, 6, 59, 59, 0, time.UTC), "2021-03-14T06:59:59Z", "2021-03-14T01:59:59-05:00"},
+		{"AtSpringForward", time.Date(2021, 3, 14, 7, 0, 0, 0, time.UTC), "2021-03-14T07:00:00Z", "2021-03-14T03:00:00-04:00"},
+
+		// Clocks go from 02:00 EDT back to 01:00 EST on 2021-11-07, so the
+		// local hour from 01:00 occurs twice with different offsets.
+		{"BeforeFallBack", time.Date(2021, 11, 7, 5, 59, 59, 0, time.UTC), "2021-11-07T05:59:59Z", "2021-11-07T01:59:59-04:00"},
+		{"AtFallBack", time.Date(2021, 11, 7, 6, 0, 0, 0, time.UTC), "2021-11-07T06:00:00Z", "2021-11-07T01:00:00-05:00"},
+		{"RepeatedHourFirst", time.Date(2021, 11, 7, 5, 30, 0, 0, time.UTC), "2021-11-07T05:30:00Z", "2021-11-07T01:30:00-04:00"},
+		{"RepeatedHourSecond", time.Date(2021, 11, 7, 6, 30, 0, 0, time.UTC), "2021-11-07T06:30:00Z", "2021-11-07T01:30:00-05:00"},
+
+		// The input's own zone must not leak into the output.
+		{"NonUTCInput", time.Date(2021, 3, 14, 3, 0, 0, 0, loc), "2021-03-14T07:00:00Z", "2021-03-14T03:00:00-04:00"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatTime(tt.t, false); got != tt.utc {
+				t.Fatalf("utc=%s, want %s", got, tt.utc)
+			}
+
+			got := formatTime(tt.t, true)
+			if got != tt.local {
+				t.Fatalf("local=%s, want %s", got, tt.local)
+			}
+
+			// The offset keeps local timestamps unambiguous across DST.
+			if parsed, err := time.Parse(time.RFC3339, got); err != nil {
+				t.Fatal(err)
+			} else if !parsed.Equal(tt.t) {
+				t.Fatalf("local timestamp parses to %s, want %s", parsed, tt.t)
+			}
+		})
+	}
+}
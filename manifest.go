@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	lss3 "github.com/benbjohnson/litestream/s3"
+)
+
+// Manifest is an inventory of the generations stored on a replica.
+type Manifest struct {
+	CreatedAt   time.Time            `json:"createdAt"`
+	Bucket      string               `json:"bucket"`
+	GenerationN int                  `json:"generationN"`
+	TotalSize   int64                `json:"totalSize"`
+	Generations []ManifestGeneration `json:"generations"`
+}
+
+// ManifestGeneration describes the recoverable range of a single generation.
+// Sizes are of the LZ4 compressed replica files so a restored database is
+// usually larger.
+type ManifestGeneration struct {
+	ID          string    `json:"id"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	MinIndex    int       `json:"minIndex"`
+	MaxIndex    int       `json:"maxIndex"`
+	SnapshotN   int       `json:"snapshotN"`
+	WALSegmentN int       `json:"walSegmentN"`
+	Size        int64     `json:"size"`
+}
+
+// runManifest executes the "manifest" subcommand. It writes a JSON inventory
+// of every generation on the replica, as listed by the replica client, so
+// the recoverable states at a point in time can be recorded.
+func runManifest(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("manifest", flag.ContinueOnError)
+	bucket := fs.String("bucket", "", "s3 replica bucket")
+	region := fs.String("region", "", "region of -bucket, looked up if empty")
+	output := fs.String("o", "manifest.json", "output path, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *bucket == "" {
+		fs.Usage()
+		return fmt.Errorf("required: -bucket NAME")
+	}
+
+	client := lss3.NewReplicaClient()
+	client.Bucket = *bucket
+	client.Region = *region
+
+	generations, err := client.Generations(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot fetch generations: %w", err)
+	}
+
+	m := Manifest{CreatedAt: time.Now().UTC(), Bucket: *bucket, Generations: []ManifestGeneration{}}
+	for _, generation := range generations {
+		g, err := describeGeneration(ctx, client, generation)
+		if err != nil {
+			return fmt.Errorf("cannot describe generation %s: %w", generation, err)
+		}
+		m.Generations = append(m.Generations, g)
+		m.TotalSize += g.Size
+	}
+	m.GenerationN = len(m.Generations)
+
+	buf, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	if *output == "-" {
+		_, err := os.Stdout.Write(buf)
+		return err
+	}
+
+	// Write to a temporary file first so a failure cannot leave a partial manifest.
+	if err := os.WriteFile(*output+".tmp", buf, 0666); err != nil {
+		return err
+	} else if err := os.Rename(*output+".tmp", *output); err != nil {
+		return err
+	}
+	fmt.Printf("manifest written: path=%s generations=%d size=%d\n", *output, m.GenerationN, m.TotalSize)
+	return nil
+}
+
+// describeGeneration returns the time bounds, index range & size of the
+// snapshots and WAL segments in generation.
+func describeGeneration(ctx context.Context, client litestream.ReplicaClient, generation string) (ManifestGeneration, error) {
+	g := ManifestGeneration{ID: generation, MinIndex: -1, MaxIndex: -1}
+	observe := func(index int, size int64, createdAt time.Time) {
+		if g.MinIndex == -1 || index < g.MinIndex {
+			g.MinIndex = index
+		}
+		if index > g.MaxIndex {
+			g.MaxIndex = index
+		}
+		if g.CreatedAt.IsZero() || createdAt.Before(g.CreatedAt) {
+			g.CreatedAt = createdAt
+		}
+		if createdAt.After(g.UpdatedAt) {
+			g.UpdatedAt = createdAt
+		}
+		g.Size += size
+	}
+
+	sitr, err := client.Snapshots(ctx, generation)
+	if err != nil {
+		return g, err
+	}
+	snapshots, err := litestream.SliceSnapshotIterator(sitr)
+	if err != nil {
+		return g, err
+	}
+	for _, info := range snapshots {
+		observe(info.Index, info.Size, info.CreatedAt)
+	}
+	g.SnapshotN = len(snapshots)
+
+	witr, err := client.WALSegments(ctx, generation)
+	if err != nil {
+		return g, err
+	}
+	segments, err := litestream.SliceWALSegmentIterator(witr)
+	if err != nil {
+		return g, err
+	}
+	for _, info := range segments {
+		observe(info.Index, info.Size, info.CreatedAt)
+	}
+	g.WALSegmentN = len(segments)
+
+	return g, nil
+}
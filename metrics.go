@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Application metrics. Litestream registers its own metrics with the default
+// registry so both are exposed on the /metrics endpoint.
+var (
+	replicaSyncSecondsHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "myapp_replica_sync_seconds",
+		Help:    "Time spent synchronously syncing the replica per request, in seconds",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	replicaSyncDurationHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "myapp_replica_sync_duration_seconds",
+		Help:    "Time spent syncing each replica in the background, on startup & on shutdown, in seconds",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"replica"})
+
+	requestBodyRejectedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "myapp_request_body_rejected_count",
+		Help: "Number of requests rejected because the declared body exceeded the size limit",
+	})
+
+	replicaThrottleCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "myapp_replica_throttle_count",
+		Help: "Number of replica syncs rejected by the object store due to rate limiting",
+	})
+
+	replicaAuthFailureCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "myapp_replica_auth_failure_count",
+		Help: "Number of replica requests rejected due to invalid or expired credentials",
+	})
+
+	replicaCredentialRefreshFailureCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "myapp_replica_credential_refresh_failure_count",
+		Help: "Number of failed proactive replica credential refreshes",
+	})
+
+	checkpointWaitSecondsHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "myapp_checkpoint_wait_seconds",
+		Help:    "Time writes spent waiting for a running checkpoint, in seconds",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	checkpointWaitTimeoutCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "myapp_checkpoint_wait_timeout_count",
+		Help: "Number of writes that stopped waiting for a checkpoint after the max wait",
+	})
+
+	checkpointSecondsHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "myapp_checkpoint_seconds",
+		Help:    "Time taken by checkpoints issued by the app, in seconds",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"mode"})
+
+	checkpointCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "myapp_checkpoint_count",
+		Help: "Number of checkpoints issued by the app",
+	}, []string{"mode"})
+
+	checkpointErrorCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "myapp_checkpoint_error_count",
+		Help: "Number of checkpoints issued by the app that failed",
+	}, []string{"mode"})
+
+	readDuringRestoreCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "myapp_read_during_restore_count",
+		Help: "Number of reads answered during a live restore, by result (stale, error)",
+	}, []string{"result"})
+
+	dbSyncCallersHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "myapp_db_sync_callers",
+		Help:    "Number of concurrent requests sharing each database sync when -sync-batching is enabled",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+
+	replicaSyncCoalescedHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "myapp_replica_sync_coalesced_writes",
+		Help:    "Number of database changes uploaded per background replica sync",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+
+	eventsDroppedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "myapp_events_dropped_count",
+		Help: "Number of replication events dropped for slow event stream clients",
+	})
+
+	fileAnomalyGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "myapp_db_file_anomaly",
+		Help: "Set to 1 while the database or WAL file size check detects an anomaly",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "myapp_retry_budget_tokens",
+		Help: "Number of retries currently available in the shared retry budget, +Inf if unlimited",
+	}, func() float64 { return retryBudget.Tokens() })
+
+	replicaPendingFramesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "myapp_replica_pending_wal_frames",
+		Help: "Number of WAL frames written locally but not yet synced to the replica, as of the last sync attempt",
+	}, []string{"replica"})
+
+	replicaDivergenceGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "myapp_replica_divergence",
+		Help: "Set to 1 while the last replica audit found the replica diverged from the local database",
+	})
+
+	verifyCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "myapp_restore_verify_count",
+		Help: "Number of background restore verifications, by replica & result (success, failure, skipped)",
+	}, []string{"replica", "result"})
+
+	verifyFailedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "myapp_restore_verify_failed",
+		Help: "Set to 1 while the last background restore verification of the replica failed",
+	}, []string{"replica"})
+
+	verifyLastSuccessGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "myapp_restore_verify_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful background restore verification of the replica",
+	}, []string{"replica"})
+
+	verifyDurationGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "myapp_restore_verify_duration_seconds",
+		Help: "Time taken by the last successful background restore verification of the replica, in seconds",
+	}, []string{"replica"})
+
+	retryBudgetExhaustedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "myapp_retry_budget_exhausted_count",
+		Help: "Number of retries refused because the shared retry budget was empty",
+	})
+
+	replicaLastSuccessGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "myapp_replica_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful sync to the replica",
+	}, []string{"replica"})
+
+	replicaConsecutiveFailuresGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "myapp_replica_consecutive_failures",
+		Help: "Number of consecutive failed syncs to the replica",
+	}, []string{"replica"})
+
+	replicaHealthyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "myapp_replica_healthy",
+		Help: "Set to 1 while the replica has fewer consecutive sync failures than -replica-unhealthy-failures",
+	}, []string{"replica"})
+
+	snapshotSkippedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "myapp_replica_snapshot_skipped_count",
+		Help: "Number of snapshots skipped because of -min-snapshot-interval",
+	}, []string{"replica"})
+
+	unexpectedGenerationChangeCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "myapp_unexpected_generation_change_count",
+		Help: "Number of generation changes not initiated by the application",
+	})
+)
+
+// observe records v on o. If traceID is set and o supports exemplars then the
+// trace ID is attached so a latency outlier can be linked to its trace.
+func observe(o prometheus.Observer, v float64, traceID string) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && traceID != "" {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	o.Observe(v)
+}
+
+// traceID returns the trace ID from the W3C "traceparent" header propagated by
+// OpenTelemetry-instrumented callers. Returns a blank string if unavailable.
+func traceID(r *http.Request) string {
+	// Format is "<version>-<trace-id>-<parent-id>-<flags>".
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || parts[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+	return parts[1]
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Auto-vacuum modes, indexed by their PRAGMA auto_vacuum value.
+var autoVacuumModes = []string{"none", "full", "incremental"}
+
+// applyStorageSettings sets the page size & auto-vacuum mode of a new
+// database. Both settings are part of the file format and can only be set
+// before the database is initialized since Litestream puts the database into
+// WAL mode, after which they can no longer be changed.
+//
+// For an existing database, the settings are only verified and an error is
+// returned if they differ. Zero values leave a setting unchanged.
+func applyStorageSettings(ctx context.Context, db *sql.DB, isNew bool, pageSize int, autoVacuum string) error {
+	if pageSize == 0 && autoVacuum == "" {
+		return nil
+	}
+
+	// Page size only applies to the connection that initializes the file.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if isNew {
+		if pageSize != 0 {
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf(`PRAGMA page_size = %d;`, pageSize)); err != nil {
+				return err
+			}
+		}
+		if autoVacuum != "" {
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf(`PRAGMA auto_vacuum = %s;`, autoVacuum)); err != nil {
+				return err
+			}
+		}
+
+		// Initialize the file with the new settings.
+		if _, err := conn.ExecContext(ctx, `VACUUM;`); err != nil {
+			return err
+		}
+	}
+
+	// Verify the settings took effect or match the existing database.
+	var actualPageSize, actualAutoVacuum int
+	if err := conn.QueryRowContext(ctx, `PRAGMA page_size;`).Scan(&actualPageSize); err != nil {
+		return err
+	} else if err := conn.QueryRowContext(ctx, `PRAGMA auto_vacuum;`).Scan(&actualAutoVacuum); err != nil {
+		return err
+	}
+
+	if pageSize != 0 && actualPageSize != pageSize {
+		return fmt.Errorf("page size mismatch, cannot change page size of an existing database: page_size=%d requested=%d", actualPageSize, pageSize)
+	} else if autoVacuum != "" && autoVacuumModes[actualAutoVacuum] != autoVacuum {
+		return fmt.Errorf("auto-vacuum mismatch, cannot change auto-vacuum of an existing database: auto_vacuum=%s requested=%s", autoVacuumModes[actualAutoVacuum], autoVacuum)
+	}
+
+	if isNew {
+		fmt.Printf("new database created: page_size=%d auto_vacuum=%s\n", actualPageSize, autoVacuumModes[actualAutoVacuum])
+	}
+	return nil
+}
+
+// tunedDriverName is the driver registered by registerTunedDriver.
+const tunedDriverName = "sqlite3-tuned"
+
+// registerTunedDriver registers a SQLite driver that sets the page cache size
+// & temporary storage mode on every new connection and returns its name. The
+// settings only last for the lifetime of a connection so setting them once
+// would miss connections opened later by the pool. Zero values leave a
+// setting at the SQLite default and the plain driver is returned if neither
+// is set. It must only be called once.
+func registerTunedDriver(cacheSize int, tempStore string) string {
+	if cacheSize == 0 && tempStore == "" {
+		return "sqlite3"
+	}
+
+	sql.Register(tunedDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if cacheSize != 0 {
+				if _, err := conn.Exec(fmt.Sprintf(`PRAGMA cache_size = %d;`, cacheSize), nil); err != nil {
+					return fmt.Errorf("cannot set cache size: %w", err)
+				}
+			}
+			if tempStore != "" {
+				if _, err := conn.Exec(fmt.Sprintf(`PRAGMA temp_store = %s;`, tempStore), nil); err != nil {
+					return fmt.Errorf("cannot set temp store: %w", err)
+				}
+			}
+			return nil
+		},
+	})
+	return tunedDriverName
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// RestoreProgress tracks the progress of a restore. Litestream does not
+// report progress directly so it is derived from the "applied wal" lines
+// written to the restore logger. Use it as the writer for RestoreOptions.Logger.
+type RestoreProgress struct {
+	mu    sync.Mutex
+	index int // last applied WAL index, -1 if none applied yet
+	w     io.Writer
+
+	// Range of WAL indexes to be applied on top of the snapshot.
+	MinIndex int
+	MaxIndex int
+}
+
+// NewRestoreProgress returns a RestoreProgress for the restore described by
+// opt. Log output is passed through to w.
+func NewRestoreProgress(ctx context.Context, replica *litestream.Replica, opt litestream.RestoreOptions, w io.Writer) (*RestoreProgress, error) {
+	if w == nil {
+		w = io.Discard
+	}
+	p := &RestoreProgress{index: -1, w: w}
+
+	// The restore begins at the latest snapshot before the target.
+	var err error
+	if opt.Index < math.MaxInt32 {
+		if p.MinIndex, err = replica.SnapshotIndexByIndex(ctx, opt.Generation, opt.Index); err != nil {
+			return nil, err
+		}
+	} else if p.MinIndex, err = replica.SnapshotIndexAt(ctx, opt.Generation, opt.Timestamp); err != nil {
+		return nil, err
+	}
+
+	// It ends at the highest WAL index before the target.
+	p.MaxIndex = p.MinIndex - 1
+	itr, err := replica.Client.WALSegments(ctx, opt.Generation)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	for itr.Next() {
+		info := itr.WALSegment()
+		if !opt.Timestamp.IsZero() && info.CreatedAt.After(opt.Timestamp) {
+			continue
+		} else if info.Index > opt.Index {
+			continue
+		} else if info.Index > p.MaxIndex {
+			p.MaxIndex = info.Index
+		}
+	}
+	if err := itr.Close(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// appliedWALRegex matches the log line written after each WAL index is applied.
+var appliedWALRegex = regexp.MustCompile(`applied wal [0-9a-f]+/([0-9a-f]{8})`)
+
+// Write parses restore log output and passes it through to the underlying writer.
+func (p *RestoreProgress) Write(b []byte) (int, error) {
+	if m := appliedWALRegex.FindSubmatch(b); m != nil {
+		if index, err := strconv.ParseInt(string(m[1]), 16, 64); err == nil {
+			p.mu.Lock()
+			p.index = int(index)
+			p.mu.Unlock()
+		}
+	}
+	return p.w.Write(b)
+}
+
+// Status returns the last applied WAL index & the fraction of WAL indexes
+// applied, between 0 and 1. A snapshot-only restore reports 0 until done.
+func (p *RestoreProgress) Status() (index int, fraction float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := p.MaxIndex - p.MinIndex + 1
+	if total <= 0 || p.index < p.MinIndex {
+		return p.index, 0
+	}
+	return p.index, float64(p.index-p.MinIndex+1) / float64(total)
+}
+
+// Restore progress reporting intervals.
+const (
+	progressBarInterval = 250 * time.Millisecond
+	progressLogInterval = 5 * time.Second
+	progressBarWidth    = 40
+)
+
+// isTerminal returns true if f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// restoreWithProgress runs the restore while reporting progress. If tty is
+// true then a progress bar is redrawn in place on stdout. Otherwise progress
+// is logged periodically so that piped output stays line-oriented.
+func restoreWithProgress(ctx context.Context, replica *litestream.Replica, opt litestream.RestoreOptions, progress *RestoreProgress, tty bool) error {
+	ch := make(chan error, 1)
+	go func() { ch <- replica.Restore(ctx, opt) }()
+
+	interval := progressLogInterval
+	if tty {
+		interval = progressBarInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	startTime := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			index, fraction := progress.Status()
+			eta := estimateRemaining(time.Since(startTime), fraction)
+			if tty {
+				fmt.Print("\r" + progressBar(fraction, eta))
+			} else {
+				log.Printf("restore progress: index=%08x percent=%.1f eta=%s", index, fraction*100, eta)
+			}
+
+		case err := <-ch:
+			if tty {
+				// Leave the finished bar on its own line.
+				if err == nil {
+					fmt.Print("\r" + progressBar(1, "0s"))
+				}
+				fmt.Println()
+			}
+			return err
+		}
+	}
+}
+
+// estimateRemaining returns the remaining time if the rest of the restore
+// proceeds at the same rate, or "-" if it cannot be estimated yet.
+func estimateRemaining(elapsed time.Duration, fraction float64) string {
+	if fraction <= 0 || fraction >= 1 {
+		return "-"
+	}
+	d := time.Duration(float64(elapsed) * (1 - fraction) / fraction)
+	return d.Round(time.Second).String()
+}
+
+// progressBar returns a single line progress bar with the percentage & ETA.
+func progressBar(fraction float64, eta string) string {
+	n := int(fraction * progressBarWidth)
+	if n > progressBarWidth {
+		n = progressBarWidth
+	}
+	bar := strings.Repeat("=", n) + strings.Repeat(" ", progressBarWidth-n)
+	return fmt.Sprintf("restoring [%s] %5.1f%% eta %-8s", bar, fraction*100, eta)
+}
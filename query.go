@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Limits applied to ad-hoc queries.
+const (
+	QueryTimeout = 5 * time.Second
+	QueryMaxRows = 1000
+)
+
+// queryDenyKeywords are keywords which are rejected anywhere in an ad-hoc
+// query, even though the read-only connection would also refuse to run them.
+var queryDenyKeywords = map[string]bool{
+	"INSERT": true, "UPDATE": true, "DELETE": true, "REPLACE": true, "UPSERT": true,
+	"CREATE": true, "DROP": true, "ALTER": true, "ATTACH": true, "DETACH": true,
+	"PRAGMA": true, "VACUUM": true, "REINDEX": true, "ANALYZE": true,
+	"BEGIN": true, "COMMIT": true, "ROLLBACK": true, "SAVEPOINT": true, "RELEASE": true,
+}
+
+// validateQuery returns an error unless q is a single SELECT statement. The
+// check is conservative so keywords inside string literals are rejected too.
+func validateQuery(q string) error {
+	q = strings.TrimSuffix(strings.TrimSpace(q), ";")
+	if q == "" {
+		return errors.New("query required")
+	} else if strings.Contains(q, ";") {
+		return errors.New("only a single statement is allowed")
+	}
+
+	words := strings.FieldsFunc(strings.ToUpper(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	if len(words) == 0 || (words[0] != "SELECT" && words[0] != "WITH") {
+		return errors.New("only SELECT statements are allowed")
+	}
+	for _, word := range words {
+		if queryDenyKeywords[word] {
+			return fmt.Errorf("keyword not allowed: %s", word)
+		}
+	}
+	return nil
+}
+
+// handleAdminQuery runs a read-only SELECT statement from the "sql" query
+// parameter and returns the rows as JSON. Statements are validated and then
+// executed on a read-only connection with a short timeout.
+func (s *Server) handleAdminQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query().Get("sql")
+	if err := validateQuery(q); err != nil {
+		Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), QueryTimeout)
+	defer cancel()
+
+	rows, err := s.ReadDB.QueryContext(ctx, q)
+	if err != nil {
+		Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Columns   []string        `json:"columns"`
+		Rows      [][]interface{} `json:"rows"`
+		Truncated bool            `json:"truncated,omitempty"`
+	}{Columns: columns, Rows: [][]interface{}{}}
+
+	for rows.Next() {
+		if len(resp.Rows) == QueryMaxRows {
+			resp.Truncated = true
+			break
+		}
+
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			Error(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		// Encode blobs & text as strings rather than base64.
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		resp.Rows = append(resp.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		Error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	JSON(w, r, resp)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// waitReady blocks until table contains at least minRows rows and then marks
+// the server as ready. An empty or near-empty table after a restore usually
+// means the restore was partial or came from the wrong replica.
+//
+// If timeout is non-zero and passes before the threshold is met then the
+// server is marked ready anyway and a warning is logged.
+func waitReady(ctx context.Context, s *Server, db *sql.DB, table string, minRows int, timeout time.Duration) {
+	query := fmt.Sprintf(`SELECT COUNT(1) FROM %s;`, quoteIdent(table))
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		var n int
+		if err := db.QueryRowContext(ctx, query).Scan(&n); err != nil && ctx.Err() == nil {
+			log.Printf("cannot check ready row count: %s", err)
+		} else if n >= minRows {
+			log.Printf("ready: table=%s rows=%d", table, n)
+			s.SetReady(true)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			log.Printf("warning: ready timeout exceeded, marking ready: table=%s rows=%d min=%d", table, n, minRows)
+			s.SetReady(true)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// warmup runs query and reads every row it returns so the pages it touches
+// are loaded into the OS page cache before real traffic arrives. Failures are
+// logged but do not prevent the server from becoming ready.
+func warmup(ctx context.Context, db *sql.DB, query string) {
+	startTime := time.Now()
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		log.Printf("cannot run warmup query: %s", err)
+		return
+	}
+	defer rows.Close()
+
+	var n int
+	for rows.Next() {
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("cannot run warmup query: %s", err)
+		return
+	}
+	log.Printf("warmup complete: rows=%d elapsed=%s", n, time.Since(startTime).Round(time.Millisecond))
+}
+
+// quoteIdent returns s quoted as a SQLite identifier.
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
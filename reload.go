@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// settings holds the settings which can be changed at runtime by a reload.
+// Background loops read them on every cycle instead of capturing them once.
+var settings Settings
+
+// Settings are durations which are updated atomically by a reload.
+type Settings struct {
+	syncInterval    int64
+	monitorInterval int64
+	shutdownTimeout int64
+}
+
+// SyncInterval returns the minimum time between background replica syncs.
+func (s *Settings) SyncInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.syncInterval))
+}
+
+// MonitorInterval returns the time between checks of the database position.
+func (s *Settings) MonitorInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.monitorInterval))
+}
+
+// ShutdownTimeout returns the time allowed for a graceful shutdown.
+func (s *Settings) ShutdownTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.shutdownTimeout))
+}
+
+// Init sets the initial values from config.
+func (s *Settings) Init(config Config) {
+	atomic.StoreInt64(&s.syncInterval, int64(config.SyncInterval))
+	atomic.StoreInt64(&s.monitorInterval, int64(config.MonitorInterval))
+	atomic.StoreInt64(&s.shutdownTimeout, int64(config.ShutdownTimeout))
+}
+
+// field returns the setting updated by the flag name, or nil if the flag
+// cannot be changed without a restart.
+func (s *Settings) field(name string) *int64 {
+	switch name {
+	case "sync-interval":
+		return &s.syncInterval
+	case "monitor-interval":
+		return &s.monitorInterval
+	case "shutdown-timeout":
+		return &s.shutdownTimeout
+	default:
+		return nil
+	}
+}
+
+// partial returns what keeps using the previous value of the setting updated
+// by the flag name until a restart, or blank if the change is fully applied.
+func (s *Settings) partial(name string) string {
+	switch name {
+	case "monitor-interval":
+		return "litestream monitor" // lsdb.MonitorInterval is read once on open
+	default:
+		return ""
+	}
+}
+
+// Reload reads flags from the file at path and applies the reloadable ones.
+// The file holds command line flags such as "-sync-interval=5s", one per
+// line, with blank lines & lines starting with "#" ignored. Changes to other
+// flags are logged as requiring a restart. Nothing is applied if any value
+// in the file is invalid.
+func (s *Settings) Reload(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var args []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			args = append(args, line)
+		}
+	}
+
+	// Accept every flag the program was started with so changes to flags
+	// which cannot be reloaded can be reported.
+	values := make(map[string]string)
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Func(f.Name, f.Usage, func(v string) error { values[f.Name] = v; return nil })
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument: %q", fs.Arg(0))
+	}
+
+	// Validate everything before applying anything.
+	durations := make(map[string]time.Duration)
+	for name, v := range values {
+		if s.field(name) == nil {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid -%s: %w", name, err)
+		} else if d <= 0 {
+			return fmt.Errorf("invalid -%s, must be greater than zero: %s", name, v)
+		}
+		durations[name] = d
+	}
+
+	for name, v := range values {
+		p := s.field(name)
+		if p == nil {
+			// Values are not logged as some flags hold secrets.
+			if flag.Lookup(name).Value.String() != v {
+				log.Printf("setting requires restart, not applied: name=%s", name)
+			}
+			continue
+		}
+
+		prev := time.Duration(atomic.SwapInt64(p, int64(durations[name])))
+		if prev != durations[name] {
+			flag.Set(name, v)
+			if unchanged := s.partial(name); unchanged != "" {
+				log.Printf("setting partially reloaded, restart to apply everywhere: name=%s prev=%s new=%s unchanged=%q", name, prev, durations[name], unchanged)
+			} else {
+				log.Printf("setting reloaded: name=%s prev=%s new=%s", name, prev, durations[name])
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	lss3 "github.com/benbjohnson/litestream/s3"
+	"github.com/pierrec/lz4/v4"
+)
+
+// SQLite WAL format sizes.
+const (
+	WALHeaderSize      = 32
+	WALFrameHeaderSize = 24
+)
+
+// runReplay executes the "replay" subcommand. It walks every WAL segment of
+// a generation on the replica and prints a summary of each transaction as one
+// JSON object per line. It only reads from the replica and never touches a
+// local database.
+func runReplay(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	bucket := fs.String("bucket", "", "s3 replica bucket")
+	generation := fs.String("generation", "", "generation to replay, defaults to the latest")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *bucket == "" {
+		fs.Usage()
+		return fmt.Errorf("required: -bucket NAME")
+	}
+
+	client := lss3.NewReplicaClient()
+	client.Bucket = *bucket
+
+	// Default to the latest generation.
+	if *generation == "" {
+		replica := litestream.NewReplica(nil, PrimaryReplicaName)
+		replica.Client = client
+
+		var err error
+		if *generation, _, err = replica.CalcRestoreTarget(ctx, litestream.NewRestoreOptions()); err != nil {
+			return err
+		} else if *generation == "" {
+			return litestream.ErrNoGeneration
+		}
+	}
+
+	itr, err := client.WALSegments(ctx, *generation)
+	if err != nil {
+		return err
+	}
+	segments, err := litestream.SliceWALSegmentIterator(itr)
+	if err != nil {
+		return err
+	}
+	sort.Sort(litestream.WALSegmentInfoSlice(segments))
+
+	r := replayer{client: client, enc: json.NewEncoder(os.Stdout)}
+	for _, info := range segments {
+		if err := r.replaySegment(ctx, info); err != nil {
+			return fmt.Errorf("cannot replay wal segment %s/%08x:%d: %w", info.Generation, info.Index, info.Offset, err)
+		}
+	}
+	return nil
+}
+
+// replayTxn is the summary printed for each transaction.
+type replayTxn struct {
+	Generation string    `json:"generation"`
+	Index      int       `json:"index"`
+	Offset     int64     `json:"offset"`     // offset of the first frame in the WAL
+	Frames     int       `json:"frames"`     // number of frames written
+	CommitSize uint32    `json:"commitSize"` // database size, in pages, after commit
+	Timestamp  time.Time `json:"timestamp"`  // time the segment was replicated
+}
+
+// replayer holds the state carried across WAL segments. A transaction may
+// span more than one segment within the same WAL index.
+type replayer struct {
+	client   litestream.ReplicaClient
+	enc      *json.Encoder
+	pageSize int
+	txn      replayTxn
+}
+
+func (r *replayer) replaySegment(ctx context.Context, info litestream.WALSegmentInfo) error {
+	rc, err := r.client.WALSegmentReader(ctx, info.Pos())
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	rd := bufio.NewReader(lz4.NewReader(rc))
+	offset := info.Offset
+
+	// Each WAL index starts with the WAL header, which holds the page size.
+	if offset == 0 {
+		hdr := make([]byte, WALHeaderSize)
+		if _, err := io.ReadFull(rd, hdr); err != nil {
+			return fmt.Errorf("cannot read wal header: %w", err)
+		}
+		if r.pageSize = int(binary.BigEndian.Uint32(hdr[8:])); r.pageSize == 1 {
+			r.pageSize = 65536
+		}
+		r.txn = replayTxn{}
+		offset += WALHeaderSize
+	} else if r.pageSize == 0 {
+		return fmt.Errorf("page size unknown, wal header segment missing")
+	}
+
+	frame := make([]byte, WALFrameHeaderSize+r.pageSize)
+	for {
+		if _, err := io.ReadFull(rd, frame); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if r.txn.Frames == 0 {
+			r.txn = replayTxn{Generation: info.Generation, Index: info.Index, Offset: offset, Timestamp: info.CreatedAt}
+		}
+		r.txn.Frames++
+		offset += int64(len(frame))
+
+		// A non-zero commit size marks the last frame of a transaction.
+		if commitSize := binary.BigEndian.Uint32(frame[4:]); commitSize != 0 {
+			r.txn.CommitSize = commitSize
+			if err := r.enc.Encode(r.txn); err != nil {
+				return err
+			}
+			r.txn = replayTxn{}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultReplicaUnhealthyFailures is the default number of consecutive sync
+// failures after which a replica is reported unhealthy.
+const DefaultReplicaUnhealthyFailures = 3
+
+// replicaHealth tracks the outcome of every sync to each replica.
+var replicaHealth = NewReplicaHealth()
+
+// ReplicaHealth records the sync results of each replica so a failing
+// replica can be identified when there are several.
+type ReplicaHealth struct {
+	mu       sync.Mutex
+	replicas map[string]*ReplicaHealthStatus
+
+	// Consecutive failures after which a replica is unhealthy.
+	Threshold int
+}
+
+// ReplicaHealthStatus is the sync health of a single replica.
+type ReplicaHealthStatus struct {
+	Name                string     `json:"name"`
+	Healthy             bool       `json:"healthy"`
+	LastSuccessAt       *time.Time `json:"lastSuccessAt,omitempty"`
+	LastFailureAt       *time.Time `json:"lastFailureAt,omitempty"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastError           string     `json:"lastError,omitempty"`
+}
+
+// NewReplicaHealth returns a new instance of ReplicaHealth.
+func NewReplicaHealth() *ReplicaHealth {
+	return &ReplicaHealth{
+		replicas:  make(map[string]*ReplicaHealthStatus),
+		Threshold: DefaultReplicaUnhealthyFailures,
+	}
+}
+
+// Record records the result of a sync to the named replica.
+func (h *ReplicaHealth) Record(name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := h.status(name)
+	now := time.Now()
+	if err != nil {
+		status.LastFailureAt = &now
+		status.ConsecutiveFailures++
+		status.LastError = err.Error()
+	} else {
+		status.LastSuccessAt = &now
+		status.ConsecutiveFailures = 0
+		replicaLastSuccessGauge.WithLabelValues(name).Set(float64(now.Unix()))
+	}
+	status.Healthy = h.Threshold <= 0 || status.ConsecutiveFailures < h.Threshold
+
+	replicaConsecutiveFailuresGauge.WithLabelValues(name).Set(float64(status.ConsecutiveFailures))
+	if status.Healthy {
+		replicaHealthyGauge.WithLabelValues(name).Set(1)
+	} else {
+		replicaHealthyGauge.WithLabelValues(name).Set(0)
+	}
+}
+
+// Status returns the health of each replica, sorted by name. Replicas which
+// have not synced yet are healthy.
+func (h *ReplicaHealth) Status(names []string) []ReplicaHealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	a := make([]ReplicaHealthStatus, 0, len(names))
+	for _, name := range names {
+		a = append(a, *h.status(name))
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Name < a[j].Name })
+	return a
+}
+
+// HealthyN returns the number of healthy replicas among names.
+func (h *ReplicaHealth) HealthyN(names []string) int {
+	var n int
+	for _, status := range h.Status(names) {
+		if status.Healthy {
+			n++
+		}
+	}
+	return n
+}
+
+// status returns the status of the named replica, creating it if needed.
+// Must be called with the lock held.
+func (h *ReplicaHealth) status(name string) *ReplicaHealthStatus {
+	status := h.replicas[name]
+	if status == nil {
+		status = &ReplicaHealthStatus{Name: name, Healthy: true}
+		h.replicas[name] = status
+	}
+	return status
+}
+
+// replicaNames returns the names of the replicas attached to the server.
+func (s *Server) replicaNames() []string {
+	names := make([]string, len(s.LSDB.Replicas))
+	for i, r := range s.LSDB.Replicas {
+		names[i] = r.Name()
+	}
+	return names
+}
+
+// handleAdminReplicas returns the sync health of every replica.
+func (s *Server) handleAdminReplicas(w http.ResponseWriter, r *http.Request) {
+	JSON(w, r, replicaHealth.Status(s.replicaNames()))
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLite files which belong to a database, by suffix.
+var dbFileSuffixes = []string{"", "-wal", "-shm"}
+
+// Policies for resolving replicas that disagree on the latest generation.
+const (
+	// Restore from the -restore-from replica regardless.
+	ReplicaConflictRestoreFrom = "restore-from"
+
+	// Restore from the replica updated most recently.
+	ReplicaConflictLatest = "latest"
+
+	// Restore from the replica with the highest WAL index.
+	ReplicaConflictHighestIndex = "highest-index"
+
+	// Refuse to restore until an operator picks a replica & generation.
+	ReplicaConflictFail = "fail"
+)
+
+// Policies for restore targets whose snapshots & WAL segments do not line up.
+const (
+	// Refuse to restore and report the inconsistency.
+	RestoreInconsistentFail = "fail"
+
+	// Restore the most recently updated generation which is consistent.
+	RestoreInconsistentFallback = "fallback"
+)
+
+// restoreTarget is the latest restorable state of a single replica.
+type restoreTarget struct {
+	replica    *litestream.Replica
+	generation string
+	updatedAt  time.Time
+	index      int
+}
+
+// selectRestoreReplica returns the replica to restore from. Each replica's
+// latest generation is compared and, if they disagree, the disagreement is
+// logged and resolved using policy. Replicas that cannot be read are logged
+// and left out of the comparison.
+func selectRestoreReplica(ctx context.Context, lsdb *litestream.DB, preferred *litestream.Replica, policy string, local bool) (*litestream.Replica, error) {
+	var targets []restoreTarget
+	for _, replica := range lsdb.Replicas {
+		generation, updatedAt, err := replica.CalcRestoreTarget(ctx, litestream.NewRestoreOptions())
+		if err != nil {
+			log.Printf("cannot determine restore target, skipping: replica=%s err=%s", replica.Name(), err)
+			continue
+		}
+
+		t := restoreTarget{replica: replica, generation: generation, updatedAt: updatedAt, index: -1}
+		if generation != "" {
+			if t.index, err = highestIndex(ctx, replica, generation); err != nil {
+				log.Printf("cannot determine highest index, skipping: replica=%s err=%s", replica.Name(), err)
+				continue
+			}
+		}
+		targets = append(targets, t)
+	}
+
+	// Nothing to resolve if every replica agrees.
+	conflict := false
+	for _, t := range targets {
+		if t.generation != targets[0].generation {
+			conflict = true
+		}
+	}
+	if !conflict {
+		return preferred, nil
+	}
+
+	log.Printf("replicas disagree on latest generation: policy=%s", policy)
+	for _, t := range targets {
+		if t.generation == "" {
+			log.Printf("replica target: replica=%s generation=none", t.replica.Name())
+			continue
+		}
+		log.Printf("replica target: replica=%s generation=%s updated=%s index=%08x", t.replica.Name(), t.generation, formatTime(t.updatedAt, local), t.index)
+	}
+
+	// Choose the best replica for the policy. Replicas without a generation
+	// are never chosen over those with one.
+	var best *restoreTarget
+	for i := range targets {
+		t := &targets[i]
+		if t.generation == "" {
+			continue
+		}
+
+		switch policy {
+		case ReplicaConflictLatest:
+			if best == nil || t.updatedAt.After(best.updatedAt) {
+				best = t
+			}
+		case ReplicaConflictHighestIndex:
+			if best == nil || t.index > best.index || (t.index == best.index && t.updatedAt.After(best.updatedAt)) {
+				best = t
+			}
+		}
+	}
+
+	switch policy {
+	case ReplicaConflictFail:
+		return nil, fmt.Errorf("replicas disagree on latest generation, choose one with -restore-from & -generation")
+	case ReplicaConflictLatest, ReplicaConflictHighestIndex:
+		log.Printf("restoring from replica chosen by policy: replica=%s generation=%s", best.replica.Name(), best.generation)
+		return best.replica, nil
+	default:
+		return preferred, nil
+	}
+}
+
+// highestIndex returns the highest snapshot or WAL index in generation.
+func highestIndex(ctx context.Context, replica *litestream.Replica, generation string) (int, error) {
+	index := -1
+
+	sitr, err := replica.Client.Snapshots(ctx, generation)
+	if err != nil {
+		return 0, err
+	}
+	defer sitr.Close()
+
+	for sitr.Next() {
+		if info := sitr.Snapshot(); info.Index > index {
+			index = info.Index
+		}
+	}
+	if err := sitr.Close(); err != nil {
+		return 0, err
+	}
+
+	witr, err := replica.Client.WALSegments(ctx, generation)
+	if err != nil {
+		return 0, err
+	}
+	defer witr.Close()
+
+	for witr.Next() {
+		if info := witr.WALSegment(); info.Index > index {
+			index = info.Index
+		}
+	}
+	if err := witr.Close(); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// validateRestoreIndex returns an error if generation on replica cannot be
+// restored to index. Restoring requires a snapshot at or before the index and
+// the index must either be that snapshot or exist in the WAL.
+func validateRestoreIndex(ctx context.Context, replica *litestream.Replica, generation string, index int) error {
+	snapshotIndex, err := replica.SnapshotIndexByIndex(ctx, generation, index)
+	if err == litestream.ErrNoSnapshots {
+		return fmt.Errorf("no snapshot at or before index %08x in generation %s", index, generation)
+	} else if err != nil {
+		return err
+	} else if snapshotIndex == index {
+		return nil
+	}
+
+	itr, err := replica.Client.WALSegments(ctx, generation)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	maxIndex := snapshotIndex
+	for itr.Next() {
+		if seg := itr.WALSegment(); seg.Index == index {
+			return nil
+		} else if seg.Index > maxIndex {
+			maxIndex = seg.Index
+		}
+	}
+	if err := itr.Close(); err != nil {
+		return err
+	}
+	return fmt.Errorf("index %08x not found in generation %s, highest index is %08x", index, generation, maxIndex)
+}
+
+// PostRestoreHookTimeout is the maximum time the post-restore hook may run.
+const PostRestoreHookTimeout = 1 * time.Minute
+
+// runPostRestoreHook runs command with the shell after a restore. The restored
+// generation & database path are passed as GENERATION & DB_PATH environment
+// variables. Output is logged.
+func runPostRestoreHook(ctx context.Context, command, generation, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, PostRestoreHookTimeout)
+	defer cancel()
+
+	startTime := time.Now()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), "GENERATION="+generation, "DB_PATH="+path)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("post-restore hook output: %s", bytes.TrimSpace(out))
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("post-restore hook complete: elapsed=%s", time.Since(startTime).Round(time.Millisecond))
+	return nil
+}
+
+// DefaultMinLocalTables is the default number of tables a local database
+// must have to be kept instead of restored over.
+const DefaultMinLocalTables = 1
+
+// localDBUsable returns true if the existing database at path is a SQLite
+// database with at least minTables tables. Zero-byte files & files which are
+// not SQLite databases, such as those left by a crashed first run, are not
+// usable. A minTables of zero accepts any existing file.
+func localDBUsable(path string, minTables int) (bool, error) {
+	if minTables <= 0 {
+		return true, nil
+	}
+
+	db, err := sql.Open("sqlite3", path+"?_query_only=true")
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var n int
+	var sqliteErr sqlite3.Error
+	if err := db.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%';`).Scan(&n); errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrNotADB {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return n >= minTables, nil
+}
+
+// hasLocalDB returns true if a usable local database exists at path.
+func hasLocalDB(path string, minTables int) (bool, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return localDBUsable(path, minTables)
+}
+
+// MaxRestoreRetargets is the number of times a restore is restarted on a new
+// generation after its target generation is deleted mid-restore.
+const MaxRestoreRetargets = 3
+
+// generationDeleted returns true if generation no longer exists on replica.
+func generationDeleted(ctx context.Context, replica *litestream.Replica, generation string) (bool, error) {
+	generations, err := replica.Client.Generations(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, g := range generations {
+		if g == generation {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// checkRestoreConsistency returns an error describing why generation cannot
+// be restored to index, if its snapshots & WAL segments do not line up. A
+// restore starts at the latest snapshot at or before index and applies every
+// WAL index from there, so a missing snapshot or a gap in the WAL would
+// otherwise fail partway through the restore with a less specific error.
+func checkRestoreConsistency(ctx context.Context, replica *litestream.Replica, generation string, index int) error {
+	snapshotIndex, err := replica.SnapshotIndexByIndex(ctx, generation, index)
+	if err == litestream.ErrNoSnapshots {
+		return fmt.Errorf("inconsistent replica: generation %s has no snapshot at or before index %08x", generation, index)
+	} else if err != nil {
+		return err
+	}
+
+	itr, err := replica.Client.WALSegments(ctx, generation)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	indexes := make(map[int]struct{})
+	maxIndex := -1
+	for itr.Next() {
+		if seg := itr.WALSegment(); seg.Index <= index {
+			indexes[seg.Index] = struct{}{}
+			if seg.Index > maxIndex {
+				maxIndex = seg.Index
+			}
+		}
+	}
+	if err := itr.Close(); err != nil {
+		return err
+	}
+
+	// A snapshot without any later WAL is restored as it is.
+	if maxIndex < 0 || maxIndex == snapshotIndex-1 {
+		return nil
+	} else if maxIndex < snapshotIndex {
+		return fmt.Errorf("inconsistent replica: generation %s has a snapshot at index %08x but its WAL ends at index %08x", generation, snapshotIndex, maxIndex)
+	}
+	for i := snapshotIndex; i <= maxIndex; i++ {
+		if _, ok := indexes[i]; !ok {
+			return fmt.Errorf("inconsistent replica: generation %s is missing WAL index %08x between snapshot index %08x and WAL index %08x", generation, i, snapshotIndex, maxIndex)
+		}
+	}
+	return nil
+}
+
+// consistentGeneration returns the most recently updated generation on
+// replica, other than exclude, which passes checkRestoreConsistency, and the
+// time it was last updated. Returns a blank generation if there is none.
+func consistentGeneration(ctx context.Context, replica *litestream.Replica, exclude string) (string, time.Time, error) {
+	generations, err := replica.Client.Generations(ctx)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot fetch generations: %w", err)
+	}
+
+	type candidate struct {
+		generation string
+		updatedAt  time.Time
+	}
+	var candidates []candidate
+	for _, generation := range generations {
+		if generation == exclude {
+			continue
+		}
+		_, updatedAt, err := replica.GenerationTimeBounds(ctx, generation)
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("cannot determine generation time bounds: %w", err)
+		}
+		candidates = append(candidates, candidate{generation, updatedAt})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].updatedAt.After(candidates[j].updatedAt) })
+
+	for _, c := range candidates {
+		if err := checkRestoreConsistency(ctx, replica, c.generation, math.MaxInt32); err != nil {
+			log.Printf("skipping inconsistent generation: replica=%s err=%s", replica.Name(), err)
+			continue
+		}
+		return c.generation, c.updatedAt, nil
+	}
+	return "", time.Time{}, nil
+}
+
+// oldestGeneration returns the generation on replica which was created first
+// and the time it was last updated. Returns a blank generation if the replica
+// has none.
+func oldestGeneration(ctx context.Context, replica *litestream.Replica) (string, time.Time, error) {
+	generations, err := replica.Client.Generations(ctx)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot fetch generations: %w", err)
+	}
+
+	var oldest string
+	var oldestCreatedAt, oldestUpdatedAt time.Time
+	for _, generation := range generations {
+		createdAt, updatedAt, err := replica.GenerationTimeBounds(ctx, generation)
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("cannot determine generation time bounds: %w", err)
+		}
+		if oldest == "" || createdAt.Before(oldestCreatedAt) {
+			oldest, oldestCreatedAt, oldestUpdatedAt = generation, createdAt, updatedAt
+		}
+	}
+	return oldest, oldestUpdatedAt, nil
+}
+
+// retargetRestore returns the latest generation to restore opt from, ignoring
+// the generation currently set on opt.
+func retargetRestore(ctx context.Context, replica *litestream.Replica, opt litestream.RestoreOptions) (string, error) {
+	opt.Generation = ""
+	generation, _, err := replica.CalcRestoreTarget(ctx, opt)
+	if err != nil {
+		return "", fmt.Errorf("cannot retarget restore: %w", err)
+	} else if generation == "" {
+		return "", fmt.Errorf("cannot retarget restore: no generation found on replica %q", replica.Name())
+	}
+	return generation, nil
+}
+
+// estimateRestoreSize returns the approximate number of bytes a restore with
+// opt will read from the replica: the starting snapshot plus the WAL segments
+// applied on top of it. Replica data is LZ4 compressed so the restored
+// database is usually larger than this.
+func estimateRestoreSize(ctx context.Context, replica *litestream.Replica, opt litestream.RestoreOptions) (int64, error) {
+	snapshotIndex, err := replica.SnapshotIndexByIndex(ctx, opt.Generation, opt.Index)
+	if err != nil {
+		return 0, err
+	}
+
+	itr, err := replica.Client.Snapshots(ctx, opt.Generation)
+	if err != nil {
+		return 0, err
+	}
+	snapshots, err := litestream.SliceSnapshotIterator(itr)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, info := range snapshots {
+		if info.Index == snapshotIndex {
+			size += info.Size
+		}
+	}
+
+	witr, err := replica.Client.WALSegments(ctx, opt.Generation)
+	if err != nil {
+		return 0, err
+	}
+	segments, err := litestream.SliceWALSegmentIterator(witr)
+	if err != nil {
+		return 0, err
+	}
+	for _, info := range segments {
+		if info.Index >= snapshotIndex && info.Index <= opt.Index {
+			size += info.Size
+		}
+	}
+	return size, nil
+}
+
+// verifyChecksum compares the SHA-256 hash of the file at path against the
+// expected hash stored in checksumPath. The checksum file may contain a bare
+// hex hash or the output of sha256sum.
+func verifyChecksum(path, checksumPath string) error {
+	buf, err := os.ReadFile(checksumPath)
+	if err != nil {
+		return fmt.Errorf("cannot read checksum file: %w", err)
+	}
+	fields := strings.Fields(string(buf))
+	if len(fields) == 0 {
+		return fmt.Errorf("checksum file is empty: %s", checksumPath)
+	}
+	expected := strings.ToLower(fields[0])
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("cannot hash database: %w", err)
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+
+	if actual != expected {
+		return fmt.Errorf("checksum mismatch: expected=%s actual=%s", expected, actual)
+	}
+	return nil
+}
+
+// removeForRestore moves an existing database aside so it can be replaced by
+// a restore. If keep is greater than zero, the database is renamed to
+// "<name>.bak.<timestamp>" and only the newest keep backups are retained.
+// Otherwise it is deleted. The WAL & SHM files are renamed alongside the
+// database so each backup can still be opened with SQLite.
+//
+// Litestream's metadata directory is removed since it describes the
+// database being replaced.
+func removeForRestore(db *litestream.DB, keep int) error {
+	path := db.Path()
+
+	if keep > 0 {
+		backupPath := path + ".bak." + time.Now().UTC().Format("20060102T150405Z")
+		for _, suffix := range dbFileSuffixes {
+			if err := os.Rename(path+suffix, backupPath+suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		fmt.Printf("local database backed up to %s\n", backupPath)
+
+		if err := pruneBackups(path, keep); err != nil {
+			return fmt.Errorf("cannot prune backups: %w", err)
+		}
+	} else {
+		for _, suffix := range dbFileSuffixes {
+			if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return os.RemoveAll(db.MetaPath())
+}
+
+// pruneBackups removes all but the newest keep backups of the database at path.
+func pruneBackups(path string, keep int) error {
+	matches, err := filepath.Glob(path + ".bak.*")
+	if err != nil {
+		return err
+	}
+
+	// Only consider the database files; the timestamp suffix sorts by time.
+	var backups []string
+	for _, match := range matches {
+		if !strings.HasSuffix(match, "-wal") && !strings.HasSuffix(match, "-shm") {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+
+	for len(backups) > keep {
+		for _, suffix := range dbFileSuffixes {
+			if err := os.Remove(backups[0] + suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		fmt.Printf("removed old database backup %s\n", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
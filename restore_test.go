@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/file"
+	"github.com/pierrec/lz4/v4"
+)
+
+func TestCheckRestoreConsistency(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		snapshots []int
+		wal       []int
+		index     int
+		err       string // substring of the expected error, if any
+	}{
+		{name: "Consistent", snapshots: []int{0}, wal: []int{0, 1, 2}, index: math.MaxInt32},
+		{name: "SnapshotOnly", snapshots: []int{0}, index: math.MaxInt32},
+		{name: "SnapshotAfterWAL", snapshots: []int{0, 3}, wal: []int{0, 1, 2}, index: math.MaxInt32},
+		{name: "LatestSnapshotBeforeIndex", snapshots: []int{0, 2}, wal: []int{2, 3}, index: math.MaxInt32},
+		{name: "GapAfterIndex", snapshots: []int{0}, wal: []int{0, 1, 3}, index: 1},
+		{name: "MissingWAL", snapshots: []int{0}, wal: []int{0, 2}, index: math.MaxInt32, err: "is missing WAL index 00000001 between snapshot index 00000000 and WAL index 00000002"},
+		{name: "NoSnapshot", wal: []int{0, 1}, index: math.MaxInt32, err: "has no snapshot at or before index 7fffffff"},
+		{name: "NoSnapshotBeforeIndex", snapshots: []int{2}, wal: []int{0, 1, 2}, index: 1, err: "has no snapshot at or before index 00000001"},
+		{name: "WALEndsBeforeSnapshot", snapshots: []int{3}, wal: []int{0}, index: math.MaxInt32, err: "has a snapshot at index 00000003 but its WAL ends at index 00000000"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			replica, client := newTestReplica(t)
+			const generation = "0000000000000001"
+			for _, index := range tt.snapshots {
+				writeTestSnapshot(t, client, generation, index, 1, time.Now())
+			}
+			for _, index := range tt.wal {
+				writeTestWALSegment(t, client, generation, index, time.Now())
+			}
+
+			err := checkRestoreConsistency(context.Background(), replica, generation, tt.index)
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error=%v, want %q", err, tt.err)
+			} else if tt.err != "" && !strings.HasPrefix(err.Error(), "inconsistent replica: generation "+generation+" ") {
+				t.Fatalf("error does not identify the generation: %s", err)
+			}
+		})
+	}
+}
+
+// Objects deleted from a replica after they were written, e.g. by a broken
+// retention job, are reported as inconsistent.
+func TestCheckRestoreConsistency_Deleted(t *testing.T) {
+	t.Run("WALSegment", func(t *testing.T) {
+		replica, client := newTestReplica(t)
+		const generation = "0000000000000001"
+		writeTestSnapshot(t, client, generation, 0, 1, time.Now())
+		for index := 0; index < 4; index++ {
+			writeTestWALSegment(t, client, generation, index, time.Now())
+		}
+		removeTestWALSegment(t, client, generation, 2)
+
+		if err := checkRestoreConsistency(context.Background(), replica, generation, math.MaxInt32); err == nil || !strings.Contains(err.Error(), "missing WAL index 00000002") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		replica, client := newTestReplica(t)
+		const generation = "0000000000000001"
+		writeTestSnapshot(t, client, generation, 0, 1, time.Now())
+		writeTestWALSegment(t, client, generation, 0, time.Now())
+		removeTestSnapshot(t, client, generation, 0)
+
+		if err := checkRestoreConsistency(context.Background(), replica, generation, math.MaxInt32); err == nil || !strings.Contains(err.Error(), "has no snapshot") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestConsistentGeneration(t *testing.T) {
+	replica, client := newTestReplica(t)
+	now := time.Now().Truncate(time.Second)
+
+	// The newest generation is missing a WAL segment.
+	writeTestSnapshot(t, client, "0000000000000003", 0, 1, now)
+	writeTestWALSegment(t, client, "0000000000000003", 0, now)
+	writeTestWALSegment(t, client, "0000000000000003", 2, now)
+	writeTestSnapshot(t, client, "0000000000000002", 0, 1, now.Add(-1*time.Hour))
+	writeTestSnapshot(t, client, "0000000000000001", 0, 1, now.Add(-2*time.Hour))
+
+	ctx := context.Background()
+	if generation, updatedAt, err := consistentGeneration(ctx, replica, ""); err != nil {
+		t.Fatal(err)
+	} else if generation != "0000000000000002" {
+		t.Fatalf("generation=%s, want the newest consistent generation", generation)
+	} else if !updatedAt.Equal(now.Add(-1 * time.Hour)) {
+		t.Fatalf("updatedAt=%s", updatedAt)
+	}
+
+	if generation, _, err := consistentGeneration(ctx, replica, "0000000000000002"); err != nil {
+		t.Fatal(err)
+	} else if generation != "0000000000000001" {
+		t.Fatalf("generation=%s, want the excluded generation to be skipped", generation)
+	}
+
+	removeTestSnapshot(t, client, "0000000000000001", 0)
+	if generation, _, err := consistentGeneration(ctx, replica, "0000000000000002"); err != nil {
+		t.Fatal(err)
+	} else if generation != "" {
+		t.Fatalf("generation=%s, want none", generation)
+	}
+}
+
+func TestRestore_Inconsistent(t *testing.T) {
+	// newReplica returns a replica whose latest generation is missing a WAL
+	// segment and whose previous generation holds a snapshot of 5 views.
+	newReplica := func(t *testing.T) *litestream.Replica {
+		replica, client := newTestReplica(t)
+		now := time.Now()
+		writeTestSnapshot(t, client, "0000000000000002", 0, 10, now)
+		for index := 0; index < 3; index++ {
+			writeTestWALSegment(t, client, "0000000000000002", index, now)
+		}
+		removeTestWALSegment(t, client, "0000000000000002", 1)
+		writeTestSnapshot(t, client, "0000000000000001", 0, 5, now.Add(-1*time.Hour))
+		return replica
+	}
+
+	t.Run("Fail", func(t *testing.T) {
+		replica := newReplica(t)
+		err := restore(context.Background(), replica, newTestRestoreConfig(RestoreInconsistentFail))
+		if err == nil {
+			t.Fatal("expected error")
+		} else if want := `cannot restore replica "file": inconsistent replica: generation 0000000000000002 is missing WAL index 00000001`; !strings.HasPrefix(err.Error(), want) {
+			t.Fatalf("error=%q, want prefix %q", err, want)
+		} else if _, err := os.Stat(replica.DB().Path()); !os.IsNotExist(err) {
+			t.Fatalf("database should not be restored: %v", err)
+		}
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		replica := newReplica(t)
+		if err := restore(context.Background(), replica, newTestRestoreConfig(RestoreInconsistentFallback)); err != nil {
+			t.Fatal(err)
+		} else if n := countTestPageViews(t, replica.DB().Path()); n != 5 {
+			t.Fatalf("restored %d page views, want 5 from the previous generation", n)
+		}
+	})
+
+	// A requested generation is never swapped for another one.
+	t.Run("FallbackPinned", func(t *testing.T) {
+		replica := newReplica(t)
+		config := newTestRestoreConfig(RestoreInconsistentFallback)
+		config.RestoreGeneration = "0000000000000002"
+		if err := restore(context.Background(), replica, config); err == nil || !strings.Contains(err.Error(), "missing WAL index 00000001") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("FallbackNoneConsistent", func(t *testing.T) {
+		replica := newReplica(t)
+		removeTestSnapshot(t, replica.Client.(*file.ReplicaClient), "0000000000000001", 0)
+		if err := restore(context.Background(), replica, newTestRestoreConfig(RestoreInconsistentFallback)); err == nil || !strings.Contains(err.Error(), "no consistent generation: inconsistent replica") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestRestore_Retarget(t *testing.T) {
+	// Retention deletes the generation being restored and a new generation
+	// is started while the restore is in progress.
+	t.Run("DeletedGeneration", func(t *testing.T) {
+		replica, client := newTestReplica(t)
+		now := time.Now()
+		writeTestSnapshot(t, client, "0000000000000002", 0, 3, now.Add(-1*time.Hour))
+		writeTestSnapshot(t, client, "0000000000000001", 0, 5, now.Add(-2*time.Hour))
+
+		deleting := newDeletingReplicaClient(t, client)
+		deleting.max = 1
+		replica.Client = deleting
+
+		if err := restore(context.Background(), replica, newTestRestoreConfig(RestoreInconsistentFail)); err != nil {
+			t.Fatal(err)
+		} else if got, want := deleting.reads, []string{"0000000000000002", "0000000000000003"}; !equalStrings(got, want) {
+			t.Fatalf("snapshot reads=%v, want %v", got, want)
+		} else if n := countTestPageViews(t, replica.DB().Path()); n != 7 {
+			t.Fatalf("restored %d page views, want 7 from the new latest generation", n)
+		}
+	})
+
+	t.Run("MaxRetargets", func(t *testing.T) {
+		replica, client := newTestReplica(t)
+		writeTestSnapshot(t, client, "0000000000000002", 0, 3, time.Now())
+
+		deleting := newDeletingReplicaClient(t, client)
+		replica.Client = deleting
+
+		if err := restore(context.Background(), replica, newTestRestoreConfig(RestoreInconsistentFail)); err == nil {
+			t.Fatal("expected error")
+		} else if len(deleting.reads) != MaxRestoreRetargets+1 {
+			t.Fatalf("snapshot reads=%v, want %d attempts", deleting.reads, MaxRestoreRetargets+1)
+		} else if _, err := os.Stat(replica.DB().Path()); !os.IsNotExist(err) {
+			t.Fatalf("database should not be restored: %v", err)
+		}
+	})
+
+	// A requested generation is never swapped for another one.
+	for _, tt := range []struct {
+		name   string
+		config func(*Config)
+		read   string
+	}{
+		{"Generation", func(c *Config) { c.RestoreGeneration = "0000000000000002" }, "0000000000000002"},
+		{"Oldest", func(c *Config) { c.RestoreOldest = true }, "0000000000000001"},
+	} {
+		t.Run("Pinned"+tt.name, func(t *testing.T) {
+			replica, client := newTestReplica(t)
+			now := time.Now()
+			writeTestSnapshot(t, client, "0000000000000002", 0, 3, now.Add(-1*time.Hour))
+			writeTestSnapshot(t, client, "0000000000000001", 0, 5, now.Add(-2*time.Hour))
+
+			deleting := newDeletingReplicaClient(t, client)
+			replica.Client = deleting
+
+			config := newTestRestoreConfig(RestoreInconsistentFail)
+			tt.config(&config)
+			if err := restore(context.Background(), replica, config); err == nil {
+				t.Fatal("expected error")
+			} else if got, want := deleting.reads, []string{tt.read}; !equalStrings(got, want) {
+				t.Fatalf("snapshot reads=%v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// newTestReplica returns a replica for a database which does not exist yet,
+// backed by a file replica client in a temporary directory.
+func newTestReplica(t *testing.T) (*litestream.Replica, *file.ReplicaClient) {
+	t.Helper()
+	dir := t.TempDir()
+	client := file.NewReplicaClient(filepath.Join(dir, "replica"))
+	replica := litestream.NewReplica(litestream.NewDB(filepath.Join(dir, "db")), "file")
+	replica.Client = client
+	return replica, client
+}
+
+// newTestRestoreConfig returns the configuration restore runs with by
+// default, apart from the inconsistency policy.
+func newTestRestoreConfig(inconsistent string) Config {
+	return Config{
+		RestoreIndex:        -1,
+		RestoreInconsistent: inconsistent,
+	}
+}
+
+// writeTestSnapshot writes a snapshot of a database holding n page views to
+// generation at index, last modified at modTime.
+func writeTestSnapshot(t *testing.T, client *file.ReplicaClient, generation string, index, n int, modTime time.Time) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE page_views (id INTEGER PRIMARY KEY, timestamp TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := db.Exec(`INSERT INTO page_views (timestamp) VALUES (?);`, formatTime(modTime, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteSnapshot(context.Background(), generation, index, compressTestData(t, buf)); err != nil {
+		t.Fatal(err)
+	}
+	path, err = client.SnapshotPath(generation, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestModTime(t, path, modTime)
+}
+
+// writeTestWALSegment writes a WAL segment to generation at index, last
+// modified at modTime. Its contents are not a valid WAL so it can only be
+// listed, not restored.
+func writeTestWALSegment(t *testing.T, client *file.ReplicaClient, generation string, index int, modTime time.Time) {
+	t.Helper()
+	pos := litestream.Pos{Generation: generation, Index: index}
+	if _, err := client.WriteWALSegment(context.Background(), pos, compressTestData(t, []byte("wal"))); err != nil {
+		t.Fatal(err)
+	}
+	path, err := client.WALSegmentPath(generation, index, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestModTime(t, path, modTime)
+}
+
+// compressTestData returns data LZ4 compressed, as replicas store it.
+func compressTestData(t *testing.T, data []byte) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := lz4.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// deletingReplicaClient wraps a file replica client and, before each
+// snapshot read, deletes the generation being read and starts a new one
+// holding 7 page views, as retention would during a restore.
+type deletingReplicaClient struct {
+	*file.ReplicaClient
+	t     *testing.T
+	max   int      // number of generations to delete, unlimited if zero
+	reads []string // generations of each snapshot read
+}
+
+func newDeletingReplicaClient(t *testing.T, client *file.ReplicaClient) *deletingReplicaClient {
+	return &deletingReplicaClient{ReplicaClient: client, t: t}
+}
+
+func (c *deletingReplicaClient) SnapshotReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	c.reads = append(c.reads, generation)
+	if c.max == 0 || len(c.reads) <= c.max {
+		if err := c.DeleteGeneration(ctx, generation); err != nil {
+			return nil, err
+		}
+		writeTestSnapshot(c.t, c.ReplicaClient, fmt.Sprintf("%016x", len(c.reads)+2), 0, 7, time.Now())
+	}
+	return c.ReplicaClient.SnapshotReader(ctx, generation, index)
+}
+
+// setTestModTime sets the modification time of the replica object at path,
+// which the file replica client reports as its creation time.
+func setTestModTime(t *testing.T, path string, modTime time.Time) {
+	t.Helper()
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// removeTestSnapshot deletes the snapshot at index from generation.
+func removeTestSnapshot(t *testing.T, client *file.ReplicaClient, generation string, index int) {
+	t.Helper()
+	path, err := client.SnapshotPath(generation, index)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// removeTestWALSegment deletes the WAL segment at index from generation.
+func removeTestWALSegment(t *testing.T, client *file.ReplicaClient, generation string, index int) {
+	t.Helper()
+	path, err := client.WALSegmentPath(generation, index, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countTestPageViews returns the number of page views in the database at path.
+func countTestPageViews(t *testing.T, path string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM page_views;`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// equalStrings returns true if a and b hold the same strings in order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
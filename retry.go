@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// DefaultRetryBudgetRefill is the default time to regain one retry token.
+const DefaultRetryBudgetRefill = 10 * time.Second
+
+// retryBudget limits retries across all replica syncs & restores. A nil
+// budget allows unlimited sync retries.
+var retryBudget *RetryBudget
+
+// RetryBudget is a token bucket shared by retried operations. Each retry
+// takes a token and tokens are regained at a fixed rate up to the capacity.
+// Once the bucket is empty, operations fail instead of retrying so a
+// sustained backend outage cannot cause unbounded retries.
+type RetryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	capacity float64
+	refill   time.Duration
+}
+
+// NewRetryBudget returns a full RetryBudget holding capacity tokens which
+// regains one token every refill.
+func NewRetryBudget(capacity int, refill time.Duration) *RetryBudget {
+	return &RetryBudget{
+		tokens:   float64(capacity),
+		last:     time.Now(),
+		capacity: float64(capacity),
+		refill:   refill,
+	}
+}
+
+// Allow takes a token and returns true if a retry may be performed.
+func (b *RetryBudget) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fill()
+	if b.tokens < 1 {
+		retryBudgetExhaustedCounter.Inc()
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Tokens returns the number of retries currently available. Returns +Inf for
+// a nil budget.
+func (b *RetryBudget) Tokens() float64 {
+	if b == nil {
+		return math.Inf(1)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fill()
+	return b.tokens
+}
+
+// fill adds the tokens regained since the last fill. Must hold mu.
+func (b *RetryBudget) fill() {
+	now := time.Now()
+	if b.refill > 0 {
+		b.tokens += float64(now.Sub(b.last)) / float64(b.refill)
+	}
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// configureRuntime sets GOMAXPROCS to maxProcs, if non-zero. Otherwise, if
+// useCgroup is true, GOMAXPROCS is derived from the container's cgroup CPU
+// quota so replication goroutines do not over-subscribe a constrained CPU.
+//
+// The memory limit is read by the Go runtime itself from the GOMEMLIMIT
+// environment variable when built with Go 1.19 or later.
+func configureRuntime(maxProcs int, useCgroup bool) {
+	source := "default"
+	if maxProcs > 0 {
+		runtime.GOMAXPROCS(maxProcs)
+		source = "flag"
+	} else if useCgroup {
+		if n, ok := cgroupCPUQuota(); ok {
+			runtime.GOMAXPROCS(n)
+			source = "cgroup"
+		}
+	}
+
+	memLimit, gogc := os.Getenv("GOMEMLIMIT"), os.Getenv("GOGC")
+	if memLimit == "" {
+		memLimit = "unset"
+	}
+	if gogc == "" {
+		gogc = "100"
+	}
+	fmt.Printf("runtime: version=%s gomaxprocs=%d (%s) gomemlimit=%s gogc=%s\n", runtime.Version(), runtime.GOMAXPROCS(0), source, memLimit, gogc)
+}
+
+// cgroupCPUQuota returns the number of CPUs allowed by the cgroup CPU quota,
+// rounded down with a minimum of one. Returns false if there is no quota.
+func cgroupCPUQuota() (int, bool) {
+	// cgroup v2 stores "<quota> <period>" where quota may be "max".
+	if buf, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(buf))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return cpuQuota(fields[0], fields[1])
+	}
+
+	// cgroup v1 stores the quota & period separately with -1 for no quota.
+	quota, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0, false
+	}
+	period, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0, false
+	}
+	return cpuQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func cpuQuota(quotaStr, periodStr string) (int, bool) {
+	quota, err := strconv.ParseInt(quotaStr, 10, 64)
+	if err != nil || quota <= 0 {
+		return 0, false
+	}
+	period, err := strconv.ParseInt(periodStr, 10, 64)
+	if err != nil || period <= 0 {
+		return 0, false
+	}
+
+	if n := int(quota / period); n > 1 {
+		return n, true
+	}
+	return 1, true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Schema drift policies.
+const (
+	// Refuse to start if the schema differs from the expected schema.
+	SchemaDriftFail = "fail"
+
+	// Log the differences and start anyway.
+	SchemaDriftWarn = "warn"
+)
+
+// schemaColumn is a column definition as reported by PRAGMA table_info.
+type schemaColumn struct {
+	name    string
+	typ     string
+	notNull bool
+	pk      int
+}
+
+func (c schemaColumn) String() string {
+	s := c.name + " " + c.typ
+	if c.notNull {
+		s += " NOT NULL"
+	}
+	if c.pk > 0 {
+		s += " PRIMARY KEY"
+	}
+	return s
+}
+
+// checkSchema compares the tables & columns of db against the DDL in the
+// file at path and returns a description of each difference. The expected
+// schema is built in a temporary in-memory database so it is compared as
+// SQLite parsed it rather than as text.
+func checkSchema(ctx context.Context, db *sql.DB, path string) ([]string, error) {
+	ddl, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read expected schema: %w", err)
+	}
+
+	expectedDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer expectedDB.Close()
+
+	// Each connection has its own in-memory database so only use one.
+	expectedDB.SetMaxOpenConns(1)
+	if _, err := expectedDB.ExecContext(ctx, string(ddl)); err != nil {
+		return nil, fmt.Errorf("cannot load expected schema: %w", err)
+	}
+
+	expected, err := readSchema(ctx, expectedDB)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read expected schema: %w", err)
+	}
+	actual, err := readSchema(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read database schema: %w", err)
+	}
+
+	var diffs []string
+	for _, table := range sortedKeys(expected) {
+		columns, ok := actual[table]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("missing table %q", table))
+			continue
+		}
+		diffs = append(diffs, diffColumns(table, expected[table], columns)...)
+	}
+	for _, table := range sortedKeys(actual) {
+		if _, ok := expected[table]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected table %q", table))
+		}
+	}
+	return diffs, nil
+}
+
+// diffColumns returns the differences between the expected & actual columns
+// of table.
+func diffColumns(table string, expected, actual []schemaColumn) []string {
+	byName := make(map[string]schemaColumn)
+	for _, c := range actual {
+		byName[c.name] = c
+	}
+
+	var diffs []string
+	for _, want := range expected {
+		got, ok := byName[want.name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("table %q: missing column %q", table, want.name))
+		} else if got != want {
+			diffs = append(diffs, fmt.Sprintf("table %q: column %q is %q, expected %q", table, want.name, got, want))
+		}
+		delete(byName, want.name)
+	}
+	for _, c := range actual {
+		if _, ok := byName[c.name]; ok {
+			diffs = append(diffs, fmt.Sprintf("table %q: unexpected column %q", table, c.name))
+		}
+	}
+	return diffs
+}
+
+// readSchema returns the columns of every table in db, excluding SQLite's
+// internal tables & the tables Litestream creates for its own bookkeeping.
+func readSchema(ctx context.Context, db *sql.DB) (map[string][]schemaColumn, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%';`)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !strings.HasPrefix(name, "_litestream_") {
+			tables = append(tables, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	schema := make(map[string][]schemaColumn)
+	for _, table := range tables {
+		rows, err := db.QueryContext(ctx, `SELECT name, type, "notnull", pk FROM pragma_table_info(?);`, table)
+		if err != nil {
+			return nil, err
+		}
+		columns := []schemaColumn{}
+		for rows.Next() {
+			var c schemaColumn
+			if err := rows.Scan(&c.name, &c.typ, &c.notNull, &c.pk); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			c.typ = strings.ToUpper(c.typ)
+			columns = append(columns, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		schema[table] = columns
+	}
+	return schema, nil
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string][]schemaColumn) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
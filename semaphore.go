@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	lss3 "github.com/benbjohnson/litestream/s3"
+)
+
+// Default settings for the restore semaphore.
+const (
+	DefaultRestoreLockTTL          = 1 * time.Minute
+	DefaultRestoreLockPollInterval = 5 * time.Second
+	DefaultRestoreLockSettleDelay  = 3 * time.Second
+)
+
+// RestoreSemaphore limits how many instances restore from the same bucket at
+// the same time.
+//
+// S3 does not offer a conditional put in the SDK version used by Litestream so
+// the semaphore is implemented as a queue of tickets. Each instance writes a
+// ticket object once when it joins the queue and an alive object which is
+// renewed in the background. Tickets are ordered by the last modified time S3
+// assigned to them, with ties broken by key, so the order does not depend on
+// any instance's clock. The first Limit tickets whose alive object was renewed
+// within TTL hold the semaphore and the rest wait. Expiry is also measured by
+// S3 time, relative to the most recently renewed alive object.
+//
+// The limit is best-effort. A ticket written while another instance is
+// listing may not be seen by it, so a position within the limit is only
+// accepted if it holds again after SettleDelay. An instance stalled for
+// longer than that, or an S3 listing which lags further behind, can still
+// let more than Limit instances restore at once.
+type RestoreSemaphore struct {
+	s3     *s3.S3
+	id     string // ticket name, blank if not in the queue
+	cancel func() // stops the renewer & waits for it to exit
+
+	Bucket string
+	Prefix string // key prefix for tickets
+
+	// Maximum number of instances that may hold the semaphore.
+	Limit int
+
+	// Time after which a ticket that has not been renewed is ignored.
+	TTL time.Duration
+
+	// Time between checks while waiting in the queue.
+	PollInterval time.Duration
+
+	// Time to wait before confirming a position within the limit.
+	SettleDelay time.Duration
+}
+
+// NewRestoreSemaphore returns a new instance of RestoreSemaphore.
+func NewRestoreSemaphore(bucket string, limit int) *RestoreSemaphore {
+	return &RestoreSemaphore{
+		cancel: func() {},
+
+		Bucket:       bucket,
+		Prefix:       "locks/restore",
+		Limit:        limit,
+		TTL:          DefaultRestoreLockTTL,
+		PollInterval: DefaultRestoreLockPollInterval,
+		SettleDelay:  DefaultRestoreLockSettleDelay,
+	}
+}
+
+// Acquire joins the queue and blocks until the semaphore is held or ctx is done.
+func (s *RestoreSemaphore) Acquire(ctx context.Context) error {
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+
+	// Generate a unique ticket name. Its position is assigned by S3.
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	s.id = fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(id))
+
+	aliveKey := s.aliveKey(s.id)
+	if err := s.put(ctx, aliveKey); err != nil {
+		return fmt.Errorf("cannot write restore ticket: %w", err)
+	} else if err := s.put(ctx, s.ticketKey(s.id)); err != nil {
+		s.Release(context.Background())
+		return fmt.Errorf("cannot write restore ticket: %w", err)
+	}
+
+	// Keep our ticket alive while waiting & while holding the semaphore.
+	renewCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { defer close(done); s.renewer(renewCtx, aliveKey) }()
+	s.cancel = func() { cancel(); <-done }
+
+	for settled := false; ; {
+		rank, err := s.rank(ctx)
+		if err != nil {
+			s.Release(context.Background())
+			return fmt.Errorf("cannot list restore tickets: %w", err)
+		} else if rank < s.Limit && settled {
+			return nil
+		}
+
+		// Check a position within the limit again once tickets written
+		// concurrently by other instances are visible.
+		wait := s.PollInterval
+		if settled = rank < s.Limit; settled {
+			wait = s.SettleDelay
+		} else {
+			log.Printf("restore concurrency limit reached, waiting: position=%d limit=%d", rank-s.Limit+1, s.Limit)
+		}
+
+		select {
+		case <-ctx.Done():
+			s.Release(context.Background())
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Release stops renewing the ticket and removes it from the queue. The renewer
+// has exited before the ticket is deleted so a renewal cannot recreate it.
+func (s *RestoreSemaphore) Release(ctx context.Context) error {
+	s.cancel()
+	s.cancel = func() {}
+	if s.id == "" {
+		return nil
+	}
+	id := s.id
+	s.id = ""
+
+	var err error
+	for _, key := range []string{s.ticketKey(id), s.aliveKey(id)} {
+		if _, e := s.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(key),
+		}); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ticketKey returns the key of the ticket which orders id in the queue.
+func (s *RestoreSemaphore) ticketKey(id string) string {
+	return path.Join(s.Prefix, "tickets", id)
+}
+
+// aliveKey returns the key of the object renewed while id is in the queue.
+func (s *RestoreSemaphore) aliveKey(id string) string {
+	return path.Join(s.Prefix, "alive", id)
+}
+
+// init creates an S3 connection in the region of the bucket.
+func (s *RestoreSemaphore) init(ctx context.Context) error {
+	sess, err := session.NewSession(awsConfig(""))
+	if err != nil {
+		return fmt.Errorf("cannot create aws session: %w", err)
+	}
+
+	region, err := s3manager.GetBucketRegion(ctx, sess, s.Bucket, lss3.DefaultRegion)
+	if err != nil {
+		return fmt.Errorf("cannot lookup bucket region: %w", err)
+	}
+	s.s3 = s3.New(sess, &aws.Config{Region: aws.String(region)})
+	return nil
+}
+
+// put writes an empty object at key, which resets its last modified time.
+func (s *RestoreSemaphore) put(ctx context.Context, key string) error {
+	_, err := s.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(nil),
+	})
+	return err
+}
+
+// renewer periodically renews the alive object at key until ctx is canceled.
+// A renewal in progress is not canceled so none is still in flight once the
+// renewer has exited.
+func (s *RestoreSemaphore) renewer(ctx context.Context, key string) {
+	ticker := time.NewTicker(s.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.put(context.Background(), key); err != nil {
+				log.Printf("cannot renew restore ticket: %s", err)
+			}
+		}
+	}
+}
+
+// rank returns our position among the live tickets in the queue.
+func (s *RestoreSemaphore) rank(ctx context.Context) (int, error) {
+	type ticket struct {
+		id       string
+		joinedAt time.Time
+	}
+	var tickets []ticket
+	alive := make(map[string]time.Time)
+	var now time.Time // latest renewal, as S3 time
+
+	if err := s.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.Prefix + "/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			dir, id := path.Split(aws.StringValue(obj.Key))
+			modTime := aws.TimeValue(obj.LastModified)
+			switch dir {
+			case path.Join(s.Prefix, "tickets") + "/":
+				tickets = append(tickets, ticket{id, modTime})
+			case path.Join(s.Prefix, "alive") + "/":
+				alive[id] = modTime
+				if modTime.After(now) {
+					now = modTime
+				}
+			}
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+
+	sort.Slice(tickets, func(i, j int) bool {
+		if !tickets[i].joinedAt.Equal(tickets[j].joinedAt) {
+			return tickets[i].joinedAt.Before(tickets[j].joinedAt)
+		}
+		return tickets[i].id < tickets[j].id
+	})
+
+	var rank int
+	for _, t := range tickets {
+		if t.id == s.id {
+			return rank, nil
+		} else if renewedAt, ok := alive[t.id]; ok && now.Sub(renewedAt) <= s.TTL {
+			rank++ // skip tickets of holders which are likely gone
+		}
+	}
+	return 0, fmt.Errorf("restore ticket not found: %s", s.ticketKey(s.id))
+}
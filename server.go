@@ -0,0 +1,681 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server represents the HTTP server for the application.
+type Server struct {
+	// Incremented on every successful page view. Used for log sampling.
+	// Accessed atomically so it must stay 64-bit aligned.
+	viewN uint64
+
+	// Last page view count served, or -1 if none has been. Served as a
+	// stale count during a live restore. Accessed atomically.
+	lastCount int64
+
+	// Number of page view writes in progress. Accessed atomically.
+	active int64
+
+	// Non-zero while a live restore replaces the database contents.
+	// Accessed atomically.
+	restoring int32
+
+	// Non-zero while in maintenance mode. Accessed atomically.
+	maintenance int32
+
+	// Non-zero once the server is ready to receive traffic. Accessed atomically.
+	ready int32
+
+	// Non-zero while the database files look corrupt. Accessed atomically.
+	unhealthy int32
+
+	mux *http.ServeMux
+
+	// Held for reading by requests that write to the database and held for
+	// writing by operations which replace the database contents.
+	writeMu sync.RWMutex
+
+	// Tracks page view writes in progress so shutdown can let them commit
+	// and sync before the database is closed.
+	inflight sync.WaitGroup
+
+	// Backoff for synchronous replica syncs while the replica is throttling.
+	throttle Throttle
+
+	// Last update times of the generations listed by the dashboard.
+	generationTimes generationTimes
+
+	Config Config
+	DB     *sql.DB
+	LSDB   *litestream.DB
+
+	// Read-only connection used by the admin query endpoint.
+	ReadDB *sql.DB
+
+	// Optional journal that visits are recorded to before insert.
+	Journal *Journal
+
+	// Optional cache used for eventually consistent page view counts.
+	CountCache *CountCache
+
+	// Optional notifier which is passed the generation after each sync.
+	GenerationNotifier *GenerationNotifier
+
+	// Detects generation changes not initiated by the application and may
+	// halt writes. A nil guard disables detection.
+	GenerationGuard *GenerationGuard
+
+	// Optional gate which holds back writes while a checkpoint runs.
+	CheckpointGate *CheckpointGate
+
+	// Optional cache of recent idempotency keys used to deduplicate retries.
+	Idempotency *IdempotencyCache
+
+	// Optional authentication required by the admin & metrics endpoints.
+	AdminAuth *AdminAuth
+
+	// File that admin actions are audited to. If nil, they are audited to
+	// the application log.
+	AdminAuditLog *AdminAuditLog
+
+	// Optional group which shares database syncs between concurrent requests.
+	SyncGroup *SyncGroup
+}
+
+// NewServer returns a new instance of Server with routes registered.
+func NewServer(config Config, db *sql.DB, lsdb *litestream.DB) *Server {
+	s := &Server{
+		lastCount: -1,
+		mux:       http.NewServeMux(),
+		Config:    config,
+		DB:        db,
+		LSDB:      lsdb,
+	}
+
+	// Compress larger responses from the read & admin endpoints, if enabled.
+	// Metrics are compressed by promhttp itself and streaming endpoints are
+	// left alone as the compressor buffers output.
+	gz := func(h http.Handler) http.Handler {
+		if !config.Compress {
+			return h
+		}
+		return compress(h, config.CompressMinSize)
+	}
+
+	// Metrics, probe & position endpoints only accept GET & HEAD. Metrics are
+	// exposed in the OpenMetrics format, when requested, so that exemplars are
+	// included.
+	s.mux.Handle("/metrics", readOnly(s.requireAdmin(promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))))
+	s.mux.Handle("/ready", readOnly(http.HandlerFunc(s.handleReady)))
+	s.mux.Handle("/healthz", readOnly(http.HandlerFunc(s.handleHealthz)))
+	s.mux.Handle("/pos", gz(readOnly(s.requireAdmin(http.HandlerFunc(s.handlePos)))))
+	s.mux.HandleFunc("/", s.handleIndex)
+
+	if config.Dashboard {
+		s.mux.Handle("/dashboard", gz(http.HandlerFunc(s.handleDashboard)))
+		s.mux.Handle("/dashboard/status", gz(http.HandlerFunc(s.handleDashboardStatus)))
+	}
+
+	// Operational endpoints which modify the database are opt-in. Every
+	// request to an admin action is audited, including denied ones.
+	if config.Admin {
+		s.mux.HandleFunc("/admin/restore", s.auditAdmin("restore", s.requireAdmin(http.HandlerFunc(s.handleAdminRestore))))
+		s.mux.HandleFunc("/admin/maintenance", s.auditAdmin("maintenance", s.requireAdmin(http.HandlerFunc(s.handleAdminMaintenance))))
+		s.mux.Handle("/admin/query", s.auditAdmin("query", gz(s.requireAdmin(http.HandlerFunc(s.handleAdminQuery)))))
+		s.mux.HandleFunc("/admin/download", s.auditAdmin("download", s.requireAdmin(http.HandlerFunc(s.handleAdminDownload))))
+		s.mux.HandleFunc("/events", s.requireAdmin(http.HandlerFunc(s.handleEvents)))
+		s.mux.Handle("/admin/replicas", gz(readOnly(s.requireAdmin(http.HandlerFunc(s.handleAdminReplicas)))))
+	}
+
+	return s
+}
+
+// ServeHTTP routes the request to the appropriate handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Maintenance() {
+		w.Header().Set("X-Maintenance", "true")
+	}
+
+	// No endpoint needs a large body so reject oversized ones upfront and
+	// stop reading any body that turns out larger than declared.
+	if limit := s.Config.MaxBodyBytes; limit > 0 {
+		if r.ContentLength > limit {
+			requestBodyRejectedCounter.Inc()
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+
+	// Remove the base path, if any, so routes match below it. Requests from
+	// a proxy which already removed it are routed as they are.
+	if p := s.Config.BasePath; p != "" && (r.URL.Path == p || strings.HasPrefix(r.URL.Path, p+"/")) {
+		r = r.Clone(r.Context())
+		r.URL.Path, r.URL.RawPath = "/"+strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, p), "/"), ""
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// readOnly wraps h so that only GET & HEAD requests are served. Other methods
+// return 405. The HTTP server omits the body from HEAD responses itself.
+func readOnly(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+// syncDB copies new WAL frames to the shadow WAL. With a SyncGroup, the sync
+// is shared with concurrent requests since one sync covers all their frames.
+func (s *Server) syncDB(ctx context.Context) error {
+	if s.SyncGroup == nil {
+		return s.LSDB.Sync(ctx)
+	}
+	return s.SyncGroup.Do(ctx, s.LSDB.Sync)
+}
+
+// Drain waits for page view writes in progress to commit and sync, or until
+// ctx is done. It must only be called once the server stops accepting
+// requests.
+func (s *Server) Drain(ctx context.Context) error {
+	ch := make(chan struct{})
+	go func() { s.inflight.Wait(); close(ch) }()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// detachedContext carries the values of a parent context but is never
+// cancelled and has no deadline.
+type detachedContext struct{ parent context.Context }
+
+// detach returns a context with the values of ctx that is not cancelled when
+// ctx is.
+func detach(ctx context.Context) context.Context { return detachedContext{ctx} }
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// Maintenance returns true if the server is in maintenance mode.
+func (s *Server) Maintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) != 0
+}
+
+// SetMaintenance enables or disables maintenance mode. While enabled, writes
+// are rejected but reads & replication continue as normal.
+func (s *Server) SetMaintenance(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&s.maintenance, v)
+}
+
+// Restoring returns true while a live restore replaces the database contents.
+func (s *Server) Restoring() bool {
+	return atomic.LoadInt32(&s.restoring) != 0
+}
+
+// SetRestoring marks a live restore as started or finished.
+func (s *Server) SetRestoring(restoring bool) {
+	var v int32
+	if restoring {
+		v = 1
+	}
+	atomic.StoreInt32(&s.restoring, v)
+}
+
+// Ready returns true if the server is ready to receive traffic.
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.ready) != 0
+}
+
+// SetReady marks the server as ready or not ready to receive traffic.
+func (s *Server) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.ready, v)
+}
+
+// Healthy returns true unless a database file anomaly has been detected or a
+// replica is repeatedly failing to authenticate.
+func (s *Server) Healthy() bool {
+	if atomic.LoadInt32(&s.unhealthy) != 0 {
+		return false
+	}
+	for _, r := range s.LSDB.Replicas {
+		if c, ok := r.Client.(*AuthClient); ok && !c.Healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+// SetHealthy marks the server as healthy or unhealthy.
+func (s *Server) SetHealthy(healthy bool) {
+	var v int32
+	if !healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&s.unhealthy, v)
+}
+
+// handleHealthz returns 200 OK while the server is healthy and 503 otherwise.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !s.Healthy() {
+		http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+		return
+	}
+	Text(w, "ok\n")
+}
+
+// PosStatus is the replication position reported by /pos.
+type PosStatus struct {
+	Pos      string             `json:"pos"`
+	Replicas []PosReplicaStatus `json:"replicas"`
+}
+
+// PosReplicaStatus is the position of a single replica and its backlog.
+type PosReplicaStatus struct {
+	Name          string `json:"name"`
+	Pos           string `json:"pos"`
+	PendingFrames int64  `json:"pendingFrames"`
+	PendingBytes  int64  `json:"pendingBytes"`
+}
+
+// handlePos returns the local & replicated positions and the number of WAL
+// frames not yet synced to each replica.
+func (s *Server) handlePos(w http.ResponseWriter, r *http.Request) {
+	// A frozen database has no replicas and never moves from its restore point.
+	if s.Config.Frozen {
+		JSON(w, r, PosStatus{Pos: s.frozenPos().String()})
+		return
+	}
+
+	pos, err := s.LSDB.Pos()
+	if err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	status := PosStatus{Pos: pos.String()}
+	for _, replica := range s.LSDB.Replicas {
+		n := pendingFrames(replica)
+		replicaPendingFramesGauge.WithLabelValues(replica.Name()).Set(float64(n))
+		status.Replicas = append(status.Replicas, PosReplicaStatus{
+			Name:          replica.Name(),
+			Pos:           replica.Pos().String(),
+			PendingFrames: n,
+			PendingBytes:  pendingBytes(replica),
+		})
+	}
+	JSON(w, r, status)
+}
+
+// frozenPos returns the position served in frozen mode. The LSDB of a frozen
+// server is never opened so it cannot report one itself.
+func (s *Server) frozenPos() litestream.Pos {
+	return litestream.Pos{Generation: s.Config.RestoreGeneration, Index: s.Config.RestoreIndex}
+}
+
+// handleReady returns 200 OK once the server is ready and 503 until then.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !s.Ready() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	} else if min := s.Config.ReadyMinHealthyReplicas; min > 0 && replicaHealth.HealthyN(s.replicaNames()) < min {
+		http.Error(w, "not ready, too few healthy replicas", http.StatusServiceUnavailable)
+		return
+	}
+	Text(w, "ok\n")
+}
+
+// handleIndex records a page view on POST and returns the total number of
+// views. GET only reads the count unless WriteOnGet is enabled.
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodGet, http.MethodHead:
+		if !s.Config.WriteOnGet {
+			s.handleCount(w, r)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		Error(w, r, fmt.Errorf("method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.inflight.Add(1)
+	defer s.inflight.Done()
+	atomic.AddInt64(&s.active, 1)
+	defer atomic.AddInt64(&s.active, -1)
+
+	// Reject writes to a frozen database, or while draining for maintenance.
+	if s.Config.Frozen {
+		Error(w, r, errors.New("server is frozen, writes are disabled"), http.StatusForbidden)
+		return
+	} else if s.Maintenance() {
+		Error(w, r, errors.New("server is in maintenance mode, writes are disabled"), http.StatusServiceUnavailable)
+		return
+	}
+
+	// If the client retries a write with the same idempotency key then
+	// return the original result instead of counting the view again.
+	key := r.Header.Get("Idempotency-Key")
+	if s.Idempotency == nil {
+		key = ""
+	}
+	var completed bool
+	if len(key) > MaxIdempotencyKeyLen {
+		Error(w, r, fmt.Errorf("Idempotency-Key header exceeds %d bytes", MaxIdempotencyKeyLen), http.StatusBadRequest)
+		return
+	} else if key != "" {
+		n, found, err := s.Idempotency.Reserve(r.Context(), key)
+		if err != nil {
+			Error(w, r, err, http.StatusServiceUnavailable)
+			return
+		} else if found {
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.Header().Set("X-Count-Consistency", s.Config.CountConsistency)
+			Text(w, "This server has been visited %d times.\n", n)
+			return
+		}
+
+		// Release the key on any failure so retries are not blocked on it.
+		defer func() {
+			if !completed {
+				s.Idempotency.Cancel(key)
+			}
+		}()
+	}
+
+	// Yield to a running checkpoint, if coordinated.
+	if s.CheckpointGate != nil {
+		if err := s.CheckpointGate.Wait(r.Context()); err != nil {
+			Error(w, r, err, http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	// Refuse writes which could corrupt a replica shared with another writer.
+	if err := s.GenerationGuard.Check(); err != nil {
+		Error(w, r, err, http.StatusServiceUnavailable)
+		return
+	}
+
+	// Once started, the local write is not cancelled if the client goes
+	// away, e.g. when a proxy drops connections during shutdown. It only
+	// touches local files so it finishes quickly either way.
+	ctx := detach(r.Context())
+
+	// Start a transaction.
+	tx, err := s.DB.Begin()
+	if err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Journal the page view before storing it, if enabled. A NULL id
+	// lets SQLite assign the row id when there is no journal.
+	timestamp := formatTime(time.Now(), s.Config.LocalTime)
+	var id sql.NullInt64
+	var committed bool
+	if s.Journal != nil {
+		if id.Int64, err = s.Journal.Append(timestamp); err != nil {
+			Error(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		id.Valid = true
+
+		defer func() {
+			if !committed {
+				if err := s.Journal.Abort(id.Int64); err != nil {
+					log.Printf("cannot abort journal entry: %s", err)
+				}
+			}
+		}()
+	}
+
+	// Store page view, along with the app version if recorded.
+	query, args := `INSERT INTO page_views (id, timestamp) VALUES (?, ?);`, []interface{}{id, timestamp}
+	if s.Config.RecordVersion {
+		query, args = `INSERT INTO page_views (id, timestamp, version) VALUES (?, ?, ?);`, append(args, version)
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); isNoSuchTable(err) {
+		Error(w, r, errors.New("page_views table does not exist, schema has not been migrated"), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Sync litestream with current state.
+	if err := s.syncDB(ctx); err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Grab current position.
+	pos, err := s.LSDB.Pos()
+	if err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Read total page views within the transaction for strict consistency.
+	// Otherwise the cached count is incremented once the write commits.
+	var n int64
+	if s.CountCache == nil {
+		if err := tx.QueryRowContext(ctx, countQuery(s.Config.CountMode)).Scan(&n); err != nil {
+			Error(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Commit transaction.
+	if err := tx.Commit(); err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	committed = true
+	replicationStats.AddVisit()
+
+	if s.CountCache != nil {
+		n = s.CountCache.Add(1)
+	}
+	atomic.StoreInt64(&s.lastCount, n)
+
+	// The view is stored so retries must not store it again, even if the
+	// replica sync below fails.
+	if key != "" {
+		s.Idempotency.Complete(key, n)
+		completed = true
+	}
+
+	// Sync litestream with current state again.
+	if err := s.syncDB(ctx); err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Grab new transaction position.
+	newPos, err := s.LSDB.Pos()
+	if err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Report the generation in case it changed.
+	if s.GenerationNotifier != nil {
+		s.GenerationNotifier.Observe(newPos.Generation)
+	}
+	s.GenerationGuard.Observe(newPos.Generation)
+
+	// Sync litestream with S3. If the replica is rate limiting us then skip
+	// the synchronous sync and leave it to monitorReplica instead.
+	startTime := time.Now()
+	var deferred bool
+	if s.throttle.Active() {
+		deferred = true
+	} else if err := s.LSDB.Replicas[0].Sync(r.Context()); isThrottleError(err) {
+		replicaThrottleCounter.Inc()
+		log.Printf("replica sync throttled, backing off: backoff=%s err=%s", s.throttle.Throttled(), err)
+		deferred = true
+	} else if err != nil {
+		replicationStats.AddFailure()
+		replicaHealth.Record(s.LSDB.Replicas[0].Name(), err)
+		replicationEvents.Publish("error", "replica=%s err=%s", s.LSDB.Replicas[0].Name(), err)
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	} else {
+		s.throttle.Succeeded()
+		replicaHealth.Record(s.LSDB.Replicas[0].Name(), nil)
+	}
+	elapsed := time.Since(startTime)
+
+	if !deferred {
+		replicationStats.AddSync(elapsed)
+		replicationEvents.Publish("sync", "replica=%s pos=%s elapsed=%s", s.LSDB.Replicas[0].Name(), s.LSDB.Replicas[0].Pos(), elapsed)
+	}
+
+	if deferred {
+		w.Header().Set("X-Replication", "deferred")
+	} else {
+		var tid string
+		if s.Config.TraceExemplars {
+			tid = traceID(r)
+		}
+		observe(replicaSyncSecondsHistogram, elapsed.Seconds(), tid)
+	}
+
+	// Log a sample of successful requests to limit log volume under load.
+	// Slow requests are always logged.
+	viewN := atomic.AddUint64(&s.viewN, 1)
+	if s.shouldLog(viewN, elapsed) {
+		log.Printf("new transaction: pre=%s post=%s elapsed=%s", pos.String(), newPos.String(), elapsed)
+	}
+
+	// Print total page views.
+	w.Header().Set("X-Count-Consistency", s.Config.CountConsistency)
+	Text(w, "This server has been visited %d times.\n", n)
+}
+
+// Policies for reads made while a live restore replaces the database.
+const (
+	// Serve the last known count, marked as stale.
+	ReadDuringRestoreStale = "stale"
+
+	// Return 503 until the restore finishes.
+	ReadDuringRestoreError = "error"
+)
+
+// handleCount returns the total number of views without recording one.
+func (s *Server) handleCount(w http.ResponseWriter, r *http.Request) {
+	if s.Restoring() && s.Config.ReadDuringRestore != "" {
+		s.handleCountDuringRestore(w, r)
+		return
+	}
+
+	var n int64
+	if s.CountCache != nil {
+		n = s.CountCache.Get()
+	} else if err := s.DB.QueryRowContext(r.Context(), countQuery(s.Config.CountMode)).Scan(&n); isNoSuchTable(err) {
+		Error(w, r, errors.New("page_views table does not exist, schema has not been migrated"), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		Error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	atomic.StoreInt64(&s.lastCount, n)
+
+	w.Header().Set("X-Count-Consistency", s.Config.CountConsistency)
+	Text(w, "This server has been visited %d times.\n", n)
+}
+
+// handleCountDuringRestore answers a read made during a live restore using
+// the -read-during-restore policy. Stale counts come from the count cache,
+// if enabled, or else the last count served. Without either, or with the
+// "error" policy, it returns 503.
+func (s *Server) handleCountDuringRestore(w http.ResponseWriter, r *http.Request) {
+	n := atomic.LoadInt64(&s.lastCount)
+	if s.CountCache != nil {
+		n = s.CountCache.Get()
+	}
+
+	if s.Config.ReadDuringRestore != ReadDuringRestoreStale || n < 0 {
+		readDuringRestoreCounter.WithLabelValues("error").Inc()
+		w.Header().Set("Retry-After", "5")
+		Error(w, r, errors.New("database restore in progress"), http.StatusServiceUnavailable)
+		return
+	}
+
+	readDuringRestoreCounter.WithLabelValues("stale").Inc()
+	w.Header().Set("X-Count-Consistency", "stale")
+	w.Header().Set("X-Stale-Reason", "restore")
+	Text(w, "This server has been visited %d times.\n", n)
+}
+
+// shouldLog returns true if the nth successful request should be logged.
+func (s *Server) shouldLog(n uint64, elapsed time.Duration) bool {
+	if s.Config.LogSlow > 0 && elapsed >= s.Config.LogSlow {
+		return true
+	}
+	return s.Config.LogSample <= 1 || n%uint64(s.Config.LogSample) == 0
+}
+
+// Text writes a plain text response. The Content-Type is always set so that
+// clients do not have to sniff it.
+func Text(w http.ResponseWriter, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	fmt.Fprintf(w, format, args...)
+}
+
+// JSON writes v as a JSON response.
+func JSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("cannot encode response: %s %s: %s", r.Method, r.URL.Path, err)
+	}
+}
+
+// Error logs err and writes its message to the client with the given status
+// code. Errors are always logged regardless of log sampling.
+func Error(w http.ResponseWriter, r *http.Request, err error, code int) {
+	log.Printf("http error: %s %s: status=%d err=%s", r.Method, r.URL.Path, code, err)
+	http.Error(w, err.Error(), code)
+}
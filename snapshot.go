@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// ErrSnapshotCooldown is returned when a snapshot is skipped because the
+// generation was snapshotted within -min-snapshot-interval.
+var ErrSnapshotCooldown = errors.New("snapshot skipped, within minimum snapshot interval")
+
+// snapshotReplica writes a snapshot of the current generation to r. Every
+// path which triggers a snapshot goes through here so that snapshots are at
+// least minInterval apart. The interval is measured from the latest snapshot
+// on the replica, so it also holds across restarts. A skipped snapshot is
+// logged with its trigger and returned as ErrSnapshotCooldown.
+func snapshotReplica(ctx context.Context, r *litestream.Replica, minInterval time.Duration, trigger string) (litestream.SnapshotInfo, error) {
+	if minInterval > 0 {
+		generation, err := r.DB().CurrentGeneration()
+		if err != nil {
+			return litestream.SnapshotInfo{}, err
+		}
+
+		last, err := lastSnapshotAt(ctx, r, generation)
+		if err != nil {
+			return litestream.SnapshotInfo{}, fmt.Errorf("cannot determine last snapshot: %w", err)
+		} else if elapsed := time.Since(last); !last.IsZero() && elapsed < minInterval {
+			remaining := (minInterval - elapsed).Round(time.Second)
+			snapshotSkippedCounter.WithLabelValues(r.Name()).Inc()
+			log.Printf("snapshot skipped, within minimum interval: replica=%s trigger=%s generation=%s last=%s remaining=%s", r.Name(), trigger, generation, last.UTC().Format(time.RFC3339), remaining)
+			return litestream.SnapshotInfo{}, fmt.Errorf("%w: retry in %s", ErrSnapshotCooldown, remaining)
+		}
+	}
+	return r.Snapshot(ctx)
+}
+
+// lastSnapshotAt returns the time of the latest snapshot of generation on r,
+// or the zero time if it has none.
+func lastSnapshotAt(ctx context.Context, r *litestream.Replica, generation string) (time.Time, error) {
+	if generation == "" {
+		return time.Time{}, nil
+	}
+
+	itr, err := r.Client.Snapshots(ctx, generation)
+	if err != nil {
+		return time.Time{}, err
+	}
+	snapshots, err := litestream.SliceSnapshotIterator(itr)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var last time.Time
+	for _, info := range snapshots {
+		if info.CreatedAt.After(last) {
+			last = info.CreatedAt
+		}
+	}
+	return last, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// replicationStats aggregates activity for the periodic summary log & the
+// CloudWatch publisher.
+var replicationStats Stats
+
+// Stats holds counts of visits & replica syncs since startup. Consumers take
+// the difference between successive totals so they can report on their own
+// intervals.
+type Stats struct {
+	mu       sync.Mutex
+	visitN   int64
+	syncN    int64
+	failureN int64
+	syncTime time.Duration
+}
+
+// AddVisit records a page view.
+func (s *Stats) AddVisit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.visitN++
+}
+
+// AddSync records a successful replica sync that took elapsed.
+func (s *Stats) AddSync(elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncN++
+	s.syncTime += elapsed
+}
+
+// AddFailure records a failed replica sync.
+func (s *Stats) AddFailure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failureN++
+}
+
+// Totals returns the counts & total sync time since startup.
+func (s *Stats) Totals() StatsTotals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return StatsTotals{VisitN: s.visitN, SyncN: s.syncN, FailureN: s.failureN, SyncTime: s.syncTime}
+}
+
+// StatsTotals is a point-in-time copy of the counts held by Stats.
+type StatsTotals struct {
+	VisitN   int64
+	SyncN    int64
+	FailureN int64
+	SyncTime time.Duration
+}
+
+// Sub returns the activity between prev and t.
+func (t StatsTotals) Sub(prev StatsTotals) StatsTotals {
+	return StatsTotals{
+		VisitN:   t.VisitN - prev.VisitN,
+		SyncN:    t.SyncN - prev.SyncN,
+		FailureN: t.FailureN - prev.FailureN,
+		SyncTime: t.SyncTime - prev.SyncTime,
+	}
+}
+
+// AvgSync returns the average time per sync, or zero if there were none.
+func (t StatsTotals) AvgSync() time.Duration {
+	if t.SyncN == 0 {
+		return 0
+	}
+	return t.SyncTime / time.Duration(t.SyncN)
+}
+
+// logSummary logs a summary of replication activity on every interval.
+func logSummary(ctx context.Context, lsdb *litestream.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	prev := replicationStats.Totals()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		totals := replicationStats.Totals()
+		stats := totals.Sub(prev)
+		prev = totals
+
+		var walSize int64
+		if fi, err := os.Stat(lsdb.WALPath()); err == nil {
+			walSize = fi.Size()
+		}
+
+		var pos litestream.Pos
+		if len(lsdb.Replicas) > 0 {
+			pos = lsdb.Replicas[0].Pos()
+		}
+
+		log.Printf("replication summary: interval=%s visits=%d syncs=%d failures=%d pos=%s wal_size=%d avg_sync=%s",
+			interval, stats.VisitN, stats.SyncN, stats.FailureN, pos, walSize, stats.AvgSync().Round(time.Millisecond))
+	}
+}
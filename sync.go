@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// Sync retry backoff defaults.
+const (
+	DefaultSyncBackoffInitial    = 1 * time.Second
+	DefaultSyncBackoffMultiplier = 2.0
+	DefaultSyncBackoffMax        = 1 * time.Minute
+)
+
+// Backoff computes exponentially increasing retry intervals.
+type Backoff struct {
+	Initial    time.Duration
+	Multiplier float64
+	Max        time.Duration
+
+	current time.Duration
+}
+
+// Next returns the next retry interval.
+func (b *Backoff) Next() time.Duration {
+	if b.current == 0 {
+		b.current = b.Initial
+	} else {
+		b.current = time.Duration(float64(b.current) * b.Multiplier)
+	}
+	if b.current > b.Max {
+		b.current = b.Max
+	}
+	return b.current
+}
+
+// Reset restarts the backoff from the initial interval.
+func (b *Backoff) Reset() {
+	b.current = 0
+}
+
+// Coalesce controls how database changes are batched into a single replica
+// sync. After a change, further changes are collected for up to Window or
+// until at least Bytes of WAL data are pending, whichever comes first. A zero
+// Window disables coalescing and a zero Bytes applies no byte threshold.
+type Coalesce struct {
+	Window time.Duration
+	Bytes  int64
+}
+
+// pendingBytes returns the approximate number of WAL bytes written to the
+// database but not yet synced to the replica.
+func pendingBytes(r *litestream.Replica) int64 {
+	dbPos, err := r.DB().Pos()
+	if err != nil {
+		return 0
+	}
+	if pos := r.Pos(); pos.Generation == dbPos.Generation && pos.Index == dbPos.Index {
+		return dbPos.Offset - pos.Offset
+	}
+	return dbPos.Offset
+}
+
+// pendingFrames returns the number of WAL frames written to the database but
+// not yet synced to the replica. If the replica is behind by a whole WAL
+// index, only the frames in the current index are counted.
+func pendingFrames(r *litestream.Replica) int64 {
+	pageSize := r.DB().PageSize()
+	dbPos, err := r.DB().Pos()
+	if err != nil || pageSize == 0 || dbPos.Offset < WALHeaderSize {
+		return 0
+	}
+
+	offset := int64(WALHeaderSize)
+	if pos := r.Pos(); pos.Generation == dbPos.Generation && pos.Index == dbPos.Index && pos.Offset > offset {
+		offset = pos.Offset
+	}
+	return (dbPos.Offset - offset) / int64(WALFrameHeaderSize+pageSize)
+}
+
+// monitorReplica replaces Litestream's replica monitor which retries failed
+// syncs only once the database changes again. Syncs are performed after each
+// database change, no more often than the current sync interval, and failed
+// syncs are retried with exponential backoff until they succeed or the shared
+// retry budget is exhausted.
+//
+// Litestream's monitor must be disabled on the replica with MonitorEnabled.
+// If set, synced is called after every successful sync.
+func monitorReplica(ctx context.Context, r *litestream.Replica, b Backoff, c Coalesce, synced func()) {
+	go enforceRetention(ctx, r)
+
+	ch := make(chan struct{})
+	close(ch)
+	var notify <-chan struct{} = ch
+
+	var wait time.Duration
+	var failures, writeN int
+	for {
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		// Wait for changes to the database, unless retrying a failed sync.
+		if failures == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-notify:
+			}
+			writeN++
+		}
+		notify = r.DB().Notify()
+
+		// Collect further changes so they are uploaded in a single sync.
+		if failures == 0 && c.Window > 0 {
+			timer := time.NewTimer(c.Window)
+		COALESCE:
+			for c.Bytes <= 0 || pendingBytes(r) < c.Bytes {
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+					break COALESCE
+				case <-notify:
+					writeN++
+					notify = r.DB().Notify()
+				}
+			}
+			timer.Stop()
+		}
+
+		prevGeneration, byteN := r.Pos().Generation, pendingBytes(r)
+		elapsed, err := syncPool.Sync(ctx, r)
+		replicaPendingFramesGauge.WithLabelValues(r.Name()).Set(float64(pendingFrames(r)))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			replicationStats.AddFailure()
+			replicationEvents.Publish("error", "replica=%s failures=%d err=%s", r.Name(), failures, err)
+
+			// Without retry budget, give up until the database changes again.
+			if !retryBudget.Allow() {
+				log.Printf("replica sync failed, retry budget exhausted: replica=%s failures=%d err=%s", r.Name(), failures, err)
+				failures, wait = 0, settings.SyncInterval()
+				b.Reset()
+				continue
+			}
+
+			wait = b.Next()
+			log.Printf("replica sync failed, retrying: replica=%s failures=%d backoff=%s err=%s", r.Name(), failures, wait, err)
+			continue
+		}
+
+		replicationStats.AddSync(elapsed)
+
+		pos := r.Pos()
+		replicationEvents.Publish("sync", "replica=%s pos=%s bytes=%d elapsed=%s", r.Name(), pos, byteN, elapsed)
+		if prevGeneration != "" && pos.Generation != prevGeneration {
+			replicationEvents.Publish("generation", "replica=%s prev=%s generation=%s", r.Name(), prevGeneration, pos.Generation)
+		}
+
+		if failures > 0 {
+			log.Printf("replica sync recovered: replica=%s failures=%d", r.Name(), failures)
+		}
+		if synced != nil {
+			synced()
+		}
+		replicaSyncCoalescedHistogram.Observe(float64(writeN))
+		failures, writeN, wait = 0, 0, settings.SyncInterval()
+		b.Reset()
+	}
+}
+
+// enforceRetention removes old snapshots & WAL segments from the replica on
+// an interval. This is normally performed by Litestream's replica monitor.
+func enforceRetention(ctx context.Context, r *litestream.Replica) {
+	if r.Retention <= 0 {
+		return
+	}
+
+	interval := r.RetentionCheckInterval
+	if interval > r.Retention {
+		interval = r.Retention
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.EnforceRetention(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("cannot enforce retention: replica=%s err=%s", r.Name(), err)
+			}
+		}
+	}
+}
+
+// syncPool bounds concurrent replica syncs. A nil pool is unbounded.
+var syncPool *SyncPool
+
+// SyncPool is a fixed number of workers shared by all replica syncs so that
+// setups with many replicas cannot exhaust connections or memory.
+type SyncPool struct {
+	sem chan struct{}
+}
+
+// NewSyncPool returns a SyncPool that runs at most n syncs at once.
+func NewSyncPool(n int) *SyncPool {
+	return &SyncPool{sem: make(chan struct{}, n)}
+}
+
+// SyncResult is the outcome of syncing a single replica.
+type SyncResult struct {
+	Replica *litestream.Replica
+	Elapsed time.Duration
+	Err     error
+}
+
+// Sync syncs r once a worker is free and returns the time spent syncing,
+// excluding the wait for a worker.
+func (p *SyncPool) Sync(ctx context.Context, r *litestream.Replica) (time.Duration, error) {
+	if p != nil {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case p.sem <- struct{}{}:
+		}
+		defer func() { <-p.sem }()
+	}
+
+	startTime := time.Now()
+	err := r.Sync(ctx)
+	elapsed := time.Since(startTime)
+	replicaSyncDurationHistogram.WithLabelValues(r.Name()).Observe(elapsed.Seconds())
+	if ctx.Err() == nil {
+		replicaHealth.Record(r.Name(), err)
+	}
+	return elapsed, err
+}
+
+// SyncAll syncs replicas concurrently, bounded by the pool's workers, and
+// returns a result for each replica in the same order.
+func (p *SyncPool) SyncAll(ctx context.Context, replicas []*litestream.Replica) []SyncResult {
+	results := make([]SyncResult, len(replicas))
+
+	var wg sync.WaitGroup
+	for i, r := range replicas {
+		wg.Add(1)
+		go func(i int, r *litestream.Replica) {
+			defer wg.Done()
+			elapsed, err := p.Sync(ctx, r)
+			results[i] = SyncResult{Replica: r, Elapsed: elapsed, Err: err}
+		}(i, r)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// SyncGroup coalesces concurrent syncs of a database into one. Callers which
+// arrive while a sync is running wait for it to finish and then share a
+// single new sync, so every caller's writes are covered by the sync it waits
+// on. Callers which arrive while no sync is running start one right away.
+type SyncGroup struct {
+	sem  chan struct{} // held while a sync is running
+	mu   sync.Mutex
+	next *syncCall // sync new callers join, if not started yet
+}
+
+// syncCall is a single sync shared by one or more callers.
+type syncCall struct {
+	done    chan struct{}
+	err     error
+	callerN int
+}
+
+// NewSyncGroup returns a new instance of SyncGroup.
+func NewSyncGroup() *SyncGroup {
+	return &SyncGroup{sem: make(chan struct{}, 1)}
+}
+
+// Do calls fn, or waits on a call of fn shared with concurrent callers, and
+// returns its error. The shared call is not cancelled when ctx is done since
+// other callers depend on it, but Do stops waiting for it.
+func (g *SyncGroup) Do(ctx context.Context, fn func(context.Context) error) error {
+	g.mu.Lock()
+	c, leader := g.next, false
+	if c == nil {
+		c, leader = &syncCall{done: make(chan struct{})}, true
+		g.next = c
+	}
+	c.callerN++
+	g.mu.Unlock()
+
+	if leader {
+		go g.run(detach(ctx), c, fn)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return c.err
+	}
+}
+
+// run waits for the running sync, if any, and then runs c for every caller
+// that joined it until then.
+func (g *SyncGroup) run(ctx context.Context, c *syncCall, fn func(context.Context) error) {
+	g.sem <- struct{}{}
+	defer func() { <-g.sem }()
+
+	g.mu.Lock()
+	g.next = nil
+	callerN := c.callerN
+	g.mu.Unlock()
+
+	dbSyncCallersHistogram.Observe(float64(callerN))
+	c.err = fn(ctx)
+	close(c.done)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Throttle backoff bounds.
+const (
+	MinThrottleBackoff = 100 * time.Millisecond
+	MaxThrottleBackoff = 30 * time.Second
+)
+
+// isThrottleError returns true if err is a rate-limit response from S3 or an
+// S3-compatible object store.
+func isThrottleError(err error) bool {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusTooManyRequests {
+		return true
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException":
+			return true
+		}
+	}
+	return false
+}
+
+// Throttle tracks an adaptive backoff for replica syncs. Each throttling
+// response doubles the backoff and each successful sync halves it. While
+// backing off, synchronous syncs are skipped and replication is left to
+// monitorReplica.
+type Throttle struct {
+	mu      sync.Mutex
+	backoff time.Duration
+	until   time.Time
+}
+
+// Active returns true if syncs should currently be skipped.
+func (t *Throttle) Active() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Now().Before(t.until)
+}
+
+// Throttled records a throttling response and returns the new backoff.
+func (t *Throttle) Throttled() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.backoff *= 2; t.backoff < MinThrottleBackoff {
+		t.backoff = MinThrottleBackoff
+	} else if t.backoff > MaxThrottleBackoff {
+		t.backoff = MaxThrottleBackoff
+	}
+	t.until = time.Now().Add(t.backoff)
+	return t.backoff
+}
+
+// Succeeded records a successful sync which reduces the backoff.
+func (t *Throttle) Succeeded() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.backoff /= 2; t.backoff < MinThrottleBackoff {
+		t.backoff = 0
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// DefaultTLSMinVersion is the minimum TLS version accepted by default.
+const DefaultTLSMinVersion = "1.2"
+
+// tlsVersions maps -tls-min-version values to TLS versions. Versions below
+// 1.2 are deliberately excluded as they are considered insecure.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig returns the TLS configuration for the web server. The cipher
+// suites are a comma-separated list of Go cipher suite names, e.g.
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". If blank, Go's secure defaults are
+// used.
+func newTLSConfig(minVersion, cipherSuites string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid -tls-min-version, must be 1.2 or 1.3: %q", minVersion)
+	}
+	config := &tls.Config{MinVersion: version}
+
+	if cipherSuites == "" {
+		return config, nil
+	}
+
+	// TLS 1.3 cipher suites are not configurable so a list would be ignored.
+	if version == tls.VersionTLS13 {
+		return nil, fmt.Errorf("-tls-cipher-suites cannot be used with -tls-min-version 1.3")
+	}
+
+	for _, name := range strings.Split(cipherSuites, ",") {
+		id, err := cipherSuiteID(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	return config, nil
+}
+
+// cipherSuiteID returns the ID of the named cipher suite. Returns an error if
+// the suite is unknown, insecure, or does not support TLS 1.2.
+func cipherSuiteID(name string) (uint16, error) {
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("insecure cipher suite: %s", name)
+		}
+	}
+
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name != name {
+			continue
+		}
+		for _, v := range suite.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				return suite.ID, nil
+			}
+		}
+		return 0, fmt.Errorf("cipher suite is not supported by TLS 1.2: %s", name)
+	}
+	return 0, fmt.Errorf("unknown cipher suite: %s", name)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+// DefaultVerifyTimeout is the default maximum time for restoring & checking
+// a single replica during background verification.
+const DefaultVerifyTimeout = 30 * time.Minute
+
+// verifyRetryDelay is the time until a verification postponed by load is
+// attempted again.
+const verifyRetryDelay = 1 * time.Minute
+
+// monitorVerify verifies that every replica is restorable on each interval
+// until ctx is done. Replicas are verified one at a time. If more than
+// -verify-max-inflight writes are in progress when a verification is due,
+// it is postponed until the server is less busy.
+func (s *Server) monitorVerify(ctx context.Context, interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if max := s.Config.VerifyMaxInflight; max > 0 {
+			if n := atomic.LoadInt64(&s.active); n > int64(max) {
+				log.Printf("restore verification postponed, server busy: inflight=%d max=%d retry=%s", n, max, verifyRetryDelay)
+				for _, r := range s.LSDB.Replicas {
+					verifyCounter.WithLabelValues(r.Name(), "skipped").Inc()
+				}
+				timer.Reset(verifyRetryDelay)
+				continue
+			}
+		}
+
+		for _, r := range s.LSDB.Replicas {
+			if err := s.verifyReplica(ctx, r); err != nil && ctx.Err() == nil {
+				verifyCounter.WithLabelValues(r.Name(), "failure").Inc()
+				verifyFailedGauge.WithLabelValues(r.Name()).Set(1)
+				log.Printf("restore verification failed: replica=%s err=%s", r.Name(), err)
+			}
+		}
+		timer.Reset(interval)
+	}
+}
+
+// verifyReplica restores the latest generation of replica to a temporary
+// file and runs PRAGMA quick_check against it. The restore uses a single
+// download worker, is bounded by -verify-timeout and is skipped if the
+// volume lacks the free space required by -restore-space-margin. The
+// temporary file is always removed.
+func (s *Server) verifyReplica(ctx context.Context, replica *litestream.Replica) error {
+	ctx, cancel := context.WithTimeout(ctx, s.Config.VerifyTimeout)
+	defer cancel()
+	startTime := time.Now()
+
+	opt := litestream.NewRestoreOptions()
+	opt.Parallelism = 1
+
+	var err error
+	if opt.Generation, _, err = replica.CalcRestoreTarget(ctx, opt); err != nil {
+		return fmt.Errorf("cannot determine restore target: %w", err)
+	} else if opt.Generation == "" {
+		verifyCounter.WithLabelValues(replica.Name(), "skipped").Inc()
+		log.Printf("restore verification skipped, no generation replicated yet: replica=%s", replica.Name())
+		return nil
+	}
+
+	// Restore into a temporary directory on the same volume as the database.
+	dir, err := os.MkdirTemp(filepath.Dir(s.LSDB.Path()), ".verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	opt.OutputPath = filepath.Join(dir, "db")
+
+	if margin := s.Config.RestoreSpaceMargin; margin > 0 {
+		if err := checkRestoreSpace(ctx, replica, opt, margin); err != nil {
+			verifyCounter.WithLabelValues(replica.Name(), "skipped").Inc()
+			log.Printf("restore verification skipped: replica=%s err=%s", replica.Name(), err)
+			return nil
+		}
+	}
+
+	if err := replica.Restore(ctx, opt); err != nil {
+		return fmt.Errorf("cannot restore generation %s: %w", opt.Generation, err)
+	} else if err := quickCheck(ctx, opt.OutputPath); err != nil {
+		return fmt.Errorf("generation %s: %w", opt.Generation, err)
+	}
+
+	elapsed := time.Since(startTime)
+	verifyCounter.WithLabelValues(replica.Name(), "success").Inc()
+	verifyFailedGauge.WithLabelValues(replica.Name()).Set(0)
+	verifyLastSuccessGauge.WithLabelValues(replica.Name()).SetToCurrentTime()
+	verifyDurationGauge.WithLabelValues(replica.Name()).Set(elapsed.Seconds())
+	log.Printf("restore verification passed: replica=%s generation=%s elapsed=%s", replica.Name(), opt.Generation, elapsed.Round(time.Millisecond))
+	return nil
+}